@@ -2,14 +2,73 @@ package mongodbutilities
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/auth"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
+// Timeout applied to the context of every helper that does not take one from the caller.
+var DefaultTimeout = 15 * time.Minute
+
+// Sets the timeout applied by the helpers that build their own context.
+func SetDefaultTimeout(timeout time.Duration) {
+	DefaultTimeout = timeout
+}
+
+// Per call options of the helpers with an Opts suffix.
+type OpOptions struct {
+	// Timeout of the operation, DefaultTimeout when zero.
+	Timeout time.Duration
+	// Write concern of write operations, e.g. writeconcern.Majority(), the database's when nil.
+	WriteConcern *writeconcern.WriteConcern
+}
+
+// Returns a context bounded by the options' timeout.
+func (instance OpOptions) Context() (context.Context, context.CancelFunc) {
+	if instance.Timeout <= 0 {
+		return NewContext()
+	}
+
+	return context.WithTimeout(context.Background(), instance.Timeout)
+}
+
+// Returns the database configured with the options' write concern.
+func (instance OpOptions) configure(database *mongo.Database) *mongo.Database {
+	if instance.WriteConcern == nil {
+		return database
+	}
+
+	return database.Client().Database(
+		database.Name(),
+		options.Database().
+			SetReadConcern(database.ReadConcern()).
+			SetReadPreference(database.ReadPreference()).
+			SetWriteConcern(instance.WriteConcern),
+	)
+}
+
+// Returns a context bounded by DefaultTimeout, the one the helpers without a Ctx suffix use.
+// Useful for operations on the raw collection, see GetCollection().
+func NewContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), DefaultTimeout)
+}
+
 // Emulates a query builder object that encompasses a collection of query filters
 type QuerySet struct {
 	// Includes all AND-ed query filters
@@ -20,8 +79,14 @@ type QuerySet struct {
 	UpdateOptions *options.UpdateOptions
 	// Additional options for the DeleteOne() and DeleteMany() collection operations.
 	DeleteOptions *options.DeleteOptions
+	// Additional options(read preference...) for the collection the operations run on.
+	CollectionOptions *options.CollectionOptions
+	// Which version of the document FindOneAndUpdate() operations return.
+	ReturnDocument *options.ReturnDocument
 	// Options for join operation
 	Joins []QueryJoin
+	// First error recorded while composing the query, returned by the operations using it.
+	Err error
 }
 
 // Info required to perform a join on another collection
@@ -46,6 +111,257 @@ func (instance *QuerySet) Exclude(queries ...map[string]interface{}) *QuerySet {
 	return instance
 }
 
+// Adds an OR-ed group of the provided filters, it will be AND-ed with the preceeding filters.
+// An empty group is ignored since Mongodb rejects an empty $or.
+func (instance *QuerySet) Or(queries ...map[string]interface{}) *QuerySet {
+	if len(queries) == 0 {
+		return instance
+	}
+
+	instance.Query = append(instance.Query, bson.M{"$or": queries})
+
+	return instance
+}
+
+// Adds a filter that skips documents marked as deleted by DeleteModelSoft()
+func (instance *QuerySet) ExcludeDeleted() *QuerySet {
+	instance.Query = append(instance.Query, bson.M{"deleted": bson.M{"$ne": true}})
+
+	return instance
+}
+
+// Adds a full text search filter, the collection needs a text index(see CreateTextIndex())
+func (instance *QuerySet) Search(text string) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{"$text": bson.M{"$search": text}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field equals any of the values.
+// No values matches no documents.
+func (instance *QuerySet) In(field string, values ...interface{}) *QuerySet {
+	if values == nil {
+		values = []interface{}{}
+	}
+
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$in": values}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field equals none of the values.
+// No values matches every document.
+func (instance *QuerySet) NotIn(field string, values ...interface{}) *QuerySet {
+	if values == nil {
+		values = []interface{}{}
+	}
+
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$nin": values}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field equals the value.
+func (instance *QuerySet) Eq(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$eq": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field does not equal the value.
+func (instance *QuerySet) Ne(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$ne": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field is greater than the value.
+func (instance *QuerySet) Gt(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$gt": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field is greater than or equal to the value.
+func (instance *QuerySet) Gte(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$gte": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field is less than the value.
+func (instance *QuerySet) Lt(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$lt": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field is less than or equal to the value.
+func (instance *QuerySet) Lte(field string, value interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$lte": value}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field lies between low and high, both inclusive.
+func (instance *QuerySet) Between(field string, low, high interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$gte": low, "$lte": high}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field matches the regular expression, e.g. options "i"
+func (instance *QuerySet) Regex(field, pattern string, options string) *QuerySet {
+	instance.Query = append(
+		instance.Query,
+		bson.M{field: primitive.Regex{Pattern: pattern, Options: options}},
+	)
+
+	return instance
+}
+
+// Adds a filter matching documents whose field contains the substring, ignoring case.
+// The substring is matched literally, regular expression characters are escaped.
+func (instance *QuerySet) Contains(field, substring string) *QuerySet {
+	return instance.Regex(field, regexp.QuoteMeta(substring), "i")
+}
+
+// Adds a filter matching documents that have(or lack when exists is false) the field.
+func (instance *QuerySet) Exists(field string, exists bool) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$exists": exists}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose field holds the BSON type, e.g. "string" or "date"
+func (instance *QuerySet) Type(field string, bsonType string) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$type": bsonType}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose array field has an element satisfying all the conditions,
+// unlike separate filters which may each be satisfied by a different element.
+func (instance *QuerySet) ElemMatch(field string, conditions interface{}) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$elemMatch": conditions}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose array field holds exactly size elements.
+func (instance *QuerySet) ArraySize(field string, size int) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{field: bson.M{"$size": size}})
+
+	return instance
+}
+
+// Adds a filter matching documents whose array field holds at least n elements,
+// by checking that the element at index n - 1 exists since $size only matches exactly.
+func (instance *QuerySet) ArrayMinSize(field string, n int) *QuerySet {
+	if n < 1 {
+		return instance.Exists(field, true)
+	}
+
+	instance.Query = append(instance.Query, bson.M{
+		field:                            bson.M{"$exists": true},
+		fmt.Sprintf("%s.%d", field, n-1): bson.M{"$exists": true},
+	})
+
+	return instance
+}
+
+// Returned when a comparison operator is not one of $eq, $ne, $gt, $gte, $lt or $lte.
+var ErrInvalidOperator = errors.New("mongodbutilities: invalid comparison operator")
+
+// Comparison operators accepted by ExprCompare().
+var comparisonOperators = map[string]bool{
+	"$eq":  true,
+	"$ne":  true,
+	"$gt":  true,
+	"$gte": true,
+	"$lt":  true,
+	"$lte": true,
+}
+
+// Adds a filter comparing two fields of the same document, e.g. ExprCompare("$gt", "spent", "budget").
+// Records ErrInvalidOperator, adding no filter, for an unknown operator.
+func (instance *QuerySet) ExprCompare(op string, fieldA, fieldB string) *QuerySet {
+	if !comparisonOperators[op] {
+		return instance.recordError(fmt.Errorf("%w: %q", ErrInvalidOperator, op))
+	}
+
+	instance.Query = append(instance.Query, bson.M{
+		"$expr": bson.M{op: bson.A{"$" + fieldA, "$" + fieldB}},
+	})
+
+	return instance
+}
+
+// Adds a filter matching documents whose GeoJSON point field lies within maxMeters of the point,
+// returned nearest first. Requires a 2dsphere index on the field, see CreateGeoIndex().
+// $near is not supported by CountDocuments() and cannot be nested in Or().
+func (instance *QuerySet) Near(field string, longitude, latitude, maxMeters float64) *QuerySet {
+	instance.Query = append(instance.Query, bson.M{
+		field: bson.M{
+			"$near": bson.M{
+				"$geometry": bson.M{
+					"type":        "Point",
+					"coordinates": bson.A{longitude, latitude},
+				},
+				"$maxDistance": maxMeters,
+			},
+		},
+	})
+
+	return instance
+}
+
+// Returned when a polygon has fewer than 3 distinct points or a point isn't a [longitude, latitude] pair.
+var ErrInvalidPolygon = errors.New("mongodbutilities: polygon needs at least 3 [longitude, latitude] points")
+
+// Adds a filter matching documents whose GeoJSON field lies within the polygon of [longitude, latitude] points.
+// Repeated points are dropped, keeping the first occurrence, and the ring is closed with the first point.
+// Records ErrInvalidPolygon, adding no filter, for an invalid polygon.
+// The QuerySet then builds to a filter matching no document rather than one ignoring the boundary.
+func (instance *QuerySet) WithinPolygon(field string, points [][]float64) *QuerySet {
+	ring := make(bson.A, 0, len(points)+1)
+	seen := map[[2]float64]bool{}
+
+	for _, point := range points {
+		if len(point) != 2 {
+			return instance.recordError(ErrInvalidPolygon)
+		}
+
+		key := [2]float64{point[0], point[1]}
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		ring = append(ring, bson.A{point[0], point[1]})
+	}
+
+	if len(ring) < 3 {
+		return instance.recordError(ErrInvalidPolygon)
+	}
+
+	ring = append(ring, ring[0])
+
+	instance.Query = append(instance.Query, bson.M{
+		field: bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": bson.A{ring},
+				},
+			},
+		},
+	})
+
+	return instance
+}
+
 // HIGHLY UNTESTED
 // Adds a join query to be evaluated to another collection
 func (instance *QuerySet) Join(
@@ -67,24 +383,54 @@ func EvaluateJoin(
 	database *mongo.Database,
 	join *QueryJoin,
 ) bson.M {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	res, err := GetDocuments(
-		database,
-		join.JoinCollection,
-		join.Query.Fields(join.JoinField), // WILL DEFINITELY BE TOO SLOW
-	)
-	if res == nil || err != nil {
-		return nil
+	return EvaluateJoinCtx(ctx, database, join)
+}
+
+// Evaluates a collection join within the provided context.
+// A join whose lookup fails matches no document, the helpers fail with the lookup error instead.
+func EvaluateJoinCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	join *QueryJoin,
+) bson.M {
+	joinQuery, err := evaluateJoinCtx(ctx, database, join)
+
+	if err != nil {
+		return bson.M{join.Field: bson.M{"$in": bson.A{}}}
+	}
+
+	return joinQuery
+}
+
+// Looks up the join field values of the documents matching the join's query, returning the lookup error.
+// The lookup runs on a copy of the join's query projected to the join field only.
+func evaluateJoinCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	join *QueryJoin,
+) (bson.M, error) {
+	lookup := CreateQuery()
+
+	if join.Query != nil {
+		lookup = join.Query.Clone()
+	}
+
+	lookup.Project(bson.M{join.JoinField: 1}) // WILL DEFINITELY BE TOO SLOW
+	res, err := GetDocumentsCtx(ctx, database, join.JoinCollection, lookup)
+
+	if err != nil {
+		return nil, err
 	}
 
 	var entries []map[string]interface{}
 	err = res.All(ctx, &entries)
 
 	if err != nil {
-		return nil
+		return nil, wrapError("Find", join.JoinCollection, err)
 	}
 
 	_ids := make([]interface{}, len(entries))
@@ -92,28 +438,115 @@ func EvaluateJoin(
 		_ids[i_] = entry[join.JoinField]
 	}
 
-	return bson.M{join.Field: bson.M{"$in": _ids}}
+	return bson.M{join.Field: bson.M{"$in": _ids}}, nil
+}
+
+// Returns the QuerySet with its joins evaluated into filters, failing with the recorded error or a lookup error.
+// A QuerySet without joins is returned as is, the QuerySet itself is never modified.
+func (instance *QuerySet) resolveJoinsCtx(ctx context.Context, database *mongo.Database) (*QuerySet, error) {
+	if instance.Err != nil {
+		return nil, instance.Err
+	}
+
+	if len(instance.Joins) == 0 {
+		return instance, nil
+	}
+
+	resolved := instance.Clone()
+	resolved.Joins = nil
+
+	for i_ := range instance.Joins {
+		joinQuery, err := evaluateJoinCtx(ctx, database, &instance.Joins[i_])
+
+		if err != nil {
+			return nil, err
+		}
+
+		resolved.Query = append(resolved.Query, joinQuery)
+	}
+
+	return resolved, nil
 }
 
 // Build the final filter to be passed to a retrieval operation
 func (instance *QuerySet) Build(database *mongo.Database) bson.M {
-	if len(instance.Joins) > 0 {
-		for _, join := range instance.Joins {
-			joinQuery := EvaluateJoin(database, &join)
+	ctx, cancel := NewContext()
 
-			if joinQuery != nil {
-				instance.Filter(joinQuery)
-			}
+	defer cancel()
+
+	return instance.BuildCtx(ctx, database)
+}
+
+// Build the final filter, evaluating any joins within the provided context.
+// A join whose lookup fails matches no document, see EvaluateJoinCtx(),
+// and so does a QuerySet that recorded an error, see BuildCheckedCtx() to get the error instead.
+// Empty filters are skipped, a single filter is returned as is and an empty
+// QuerySet builds to an empty filter that matches every document.
+func (instance *QuerySet) BuildCtx(ctx context.Context, database *mongo.Database) bson.M {
+	// The filter the error was recorded for is missing, leaving the others would widen the match.
+	if instance.Err != nil {
+		return bson.M{"_id": bson.M{"$in": bson.A{}}}
+	}
+
+	queries := make([]map[string]interface{}, 0, len(instance.Query)+len(instance.Joins))
+
+	for _, query := range instance.Query {
+		if len(query) > 0 {
+			queries = append(queries, query)
 		}
+	}
 
-		query := bson.M{"$and": instance.Query}
+	for _, join := range instance.Joins {
+		joinQuery := EvaluateJoinCtx(ctx, database, &join)
 
-		return query
-	} else {
-		query := bson.M{"$and": instance.Query}
+		if joinQuery != nil {
+			queries = append(queries, joinQuery)
+		}
+	}
+
+	switch len(queries) {
+	case 0:
+		return bson.M{}
+	case 1:
+		return bson.M(queries[0])
+	default:
+		return bson.M{"$and": queries}
+	}
+}
+
+// Build the final filter like Build(), failing with the recorded error or a join lookup error.
+func (instance *QuerySet) BuildChecked(database *mongo.Database) (bson.M, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return instance.BuildCheckedCtx(ctx, database)
+}
+
+// Build the final filter within the provided context, failing with the recorded error or a join lookup error.
+func (instance *QuerySet) BuildCheckedCtx(ctx context.Context, database *mongo.Database) (bson.M, error) {
+	resolved, err := instance.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resolved.BuildCtx(ctx, database), nil
+}
 
-		return query
+// Reports whether the QuerySet holds any non-empty filter or join.
+func (instance *QuerySet) hasFilters() bool {
+	if len(instance.Joins) > 0 {
+		return true
+	}
+
+	for _, query := range instance.Query {
+		if len(query) > 0 {
+			return true
+		}
 	}
+
+	return false
 }
 
 // Initializes the additional options.(for Find, Update*, and Delete* operations)
@@ -133,6 +566,69 @@ func (instance *QuerySet) InitializeOptions() *QuerySet {
 	return instance
 }
 
+// Copies the QuerySet so filters and options can be added to the copy without affecting the original.
+// The filters are copied, the driver options structs are shallow copies sharing any nested values.
+func (instance *QuerySet) Clone() *QuerySet {
+	clone := *instance
+
+	if instance.Query != nil {
+		clone.Query = make([]map[string]interface{}, len(instance.Query))
+
+		for i_, query := range instance.Query {
+			clone.Query[i_] = make(map[string]interface{}, len(query))
+
+			for key, value := range query {
+				clone.Query[i_][key] = value
+			}
+		}
+	}
+
+	if instance.Joins != nil {
+		clone.Joins = append([]QueryJoin{}, instance.Joins...)
+	}
+
+	if instance.FindOptions != nil {
+		findOptions := *instance.FindOptions
+		clone.FindOptions = &findOptions
+	}
+
+	if instance.UpdateOptions != nil {
+		updateOptions := *instance.UpdateOptions
+		clone.UpdateOptions = &updateOptions
+	}
+
+	if instance.DeleteOptions != nil {
+		deleteOptions := *instance.DeleteOptions
+		clone.DeleteOptions = &deleteOptions
+	}
+
+	if instance.CollectionOptions != nil {
+		collectionOptions := *instance.CollectionOptions
+		clone.CollectionOptions = &collectionOptions
+	}
+
+	if instance.ReturnDocument != nil {
+		returnDocument := *instance.ReturnDocument
+		clone.ReturnDocument = &returnDocument
+	}
+
+	return &clone
+}
+
+// Clears the filters, joins and options so the QuerySet can be reused without allocating a new one.
+func (instance *QuerySet) Reset() *QuerySet {
+	instance.Query = instance.Query[:0]
+	instance.Joins = instance.Joins[:0]
+	instance.FindOptions = nil
+	instance.UpdateOptions = nil
+	instance.DeleteOptions = nil
+	instance.CollectionOptions = nil
+	instance.ReturnDocument = nil
+	instance.Err = nil
+
+	return instance
+}
+
 // Sets the limit option for a Find operation
 func (instance *QuerySet) Limit(limit int) *QuerySet {
 	instance.InitializeOptions()
@@ -149,6 +645,28 @@ func (instance *QuerySet) Sort(sort interface{}) *QuerySet {
 	return instance
 }
 
+// A field to sort by and its direction, see QuerySet.SortBy()
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Sets the sort options for a Find operation from the fields, in the order given.
+// Unlike a multi-key bson.M passed to Sort(), the order of the keys is deterministic.
+func (instance *QuerySet) SortBy(fields ...SortField) *QuerySet {
+	sort := make(bson.D, len(fields))
+
+	for i_, field := range fields {
+		if field.Desc {
+			sort[i_] = bson.E{Key: field.Field, Value: -1}
+		} else {
+			sort[i_] = bson.E{Key: field.Field, Value: 1}
+		}
+	}
+
+	return instance.Sort(sort)
+}
+
 // Sets the skip option for a Find operation.
 func (instance *QuerySet) Skip(limit int) *QuerySet {
 	instance.InitializeOptions()
@@ -157,39 +675,716 @@ func (instance *QuerySet) Skip(limit int) *QuerySet {
 	return instance
 }
 
-// Selects specific fields
-func (instance *QuerySet) Fields(fields ...string) *QuerySet {
+// Sets the number of documents per batch for a Find operation's cursor.
+func (instance *QuerySet) BatchSize(batchSize int) *QuerySet {
 	instance.InitializeOptions()
-	filterFields := make(map[string]int8)
-	for _, field := range fields {
-		filterFields[field] = 1
-	}
-
-	instance.FindOptions = instance.FindOptions.SetProjection(filterFields)
+	instance.FindOptions = instance.FindOptions.SetBatchSize(int32(batchSize))
 
 	return instance
 }
 
-// Exclude specific fields
-func (instance *QuerySet) ExcludeFields(fields ...string) *QuerySet {
+// Sets the collation(locale aware string comparison) of the Find, Update*, Delete* and count operations.
+func (instance *QuerySet) Collation(collation *options.Collation) *QuerySet {
 	instance.InitializeOptions()
-	filterFields := make(map[string]int8)
-
-	for _, field := range fields {
-		filterFields[field] = 0
-	}
-
-	instance.FindOptions = instance.FindOptions.SetProjection(filterFields)
+	instance.FindOptions = instance.FindOptions.SetCollation(collation)
+	instance.UpdateOptions = instance.UpdateOptions.SetCollation(collation)
+	instance.DeleteOptions = instance.DeleteOptions.SetCollation(collation)
 
 	return instance
 }
 
-// Initializes a QuerySet instance for an initial set of queries
-func CreateQuery(queries ...map[string]interface{}) *QuerySet {
-	var query QuerySet
-	query.Filter(queries...)
+// Compares strings ignoring case(but not diacritics) for the locale, e.g. "en"
+func (instance *QuerySet) CaseInsensitive(locale string) *QuerySet {
+	return instance.Collation(&options.Collation{Locale: locale, Strength: 2})
+}
 
-	return &query
+// Forces the index, by name or key specification, used by the Find, Update*, Delete* and count operations.
+// An invalid hint fails the operation with the driver's error.
+func (instance *QuerySet) Hint(index interface{}) *QuerySet {
+	instance.InitializeOptions()
+	instance.FindOptions = instance.FindOptions.SetHint(index)
+	instance.UpdateOptions = instance.UpdateOptions.SetHint(index)
+	instance.DeleteOptions = instance.DeleteOptions.SetHint(index)
+
+	return instance
+}
+
+// Sets the time the server may spend on a Find or count operation before aborting it,
+// independently of the client side context.
+func (instance *QuerySet) MaxTime(maxTime time.Duration) *QuerySet {
+	instance.InitializeOptions()
+	instance.FindOptions = instance.FindOptions.SetMaxTime(maxTime)
+
+	return instance
+}
+
+// Lets the server spill large Find sorts to disk instead of failing on its memory limit.
+func (instance *QuerySet) AllowDiskUse(allowDiskUse bool) *QuerySet {
+	instance.InitializeOptions()
+	instance.FindOptions = instance.FindOptions.SetAllowDiskUse(allowDiskUse)
+
+	return instance
+}
+
+// Sets the upsert option for UpdateOne() and UpdateMany() operations.
+func (instance *QuerySet) Upsert(upsert bool) *QuerySet {
+	instance.InitializeOptions()
+	instance.UpdateOptions = instance.UpdateOptions.SetUpsert(upsert)
+
+	return instance
+}
+
+// Sets whether FindOneAndUpdate() operations return the updated document instead of the original.
+func (instance *QuerySet) ReturnUpdated(returnUpdated bool) *QuerySet {
+	returnDocument := options.Before
+
+	if returnUpdated {
+		returnDocument = options.After
+	}
+
+	instance.ReturnDocument = &returnDocument
+
+	return instance
+}
+
+// Returned when a projection mixes included and excluded fields.
+var ErrMixedProjection = errors.New("mongodbutilities: projection cannot mix included and excluded fields")
+
+// Selects specific fields
+func (instance *QuerySet) Fields(fields ...string) *QuerySet {
+	return instance.projectFields(fields, 1)
+}
+
+// Exclude specific fields, e.g. sensitive ones, from the documents returned.
+// Cannot be combined with Fields(), except for the _id field.
+func (instance *QuerySet) ExcludeFields(fields ...string) *QuerySet {
+	return instance.projectFields(fields, 0)
+}
+
+// Merges the fields into the include/exclude projection, recording ErrMixedProjection on a mix.
+// Other values of an existing projection, e.g. {"$meta": "textScore"} or a $slice, are kept as is.
+func (instance *QuerySet) projectFields(fields []string, value int8) *QuerySet {
+	instance.InitializeOptions()
+	filterFields := bson.M{}
+
+	if instance.FindOptions.Projection != nil {
+		raw, err := bson.Marshal(instance.FindOptions.Projection)
+
+		if err != nil {
+			return instance.recordError(fmt.Errorf("mongodbutilities: invalid projection: %w", err))
+		}
+
+		_ = bson.Unmarshal(raw, &filterFields)
+	}
+
+	for _, field := range fields {
+		filterFields[field] = value
+	}
+
+	included, excluded := false, false
+
+	for field, existing := range filterFields {
+		if field == "_id" {
+			continue
+		}
+
+		include, isFlag := projectionFlag(existing)
+
+		if !isFlag {
+			continue
+		}
+
+		if include {
+			included = true
+		} else {
+			excluded = true
+		}
+	}
+
+	if included && excluded {
+		instance.recordError(ErrMixedProjection)
+	}
+
+	instance.FindOptions = instance.FindOptions.SetProjection(filterFields)
+
+	return instance
+}
+
+// Reports whether a projection value includes its field,
+// isFlag is false for the values computing the field instead, e.g. {"$meta": "textScore"}.
+func projectionFlag(value interface{}) (include bool, isFlag bool) {
+	switch value := value.(type) {
+	case bool:
+		return value, true
+	case int8:
+		return value != 0, true
+	case int32:
+		return value != 0, true
+	case int64:
+		return value != 0, true
+	case int:
+		return value != 0, true
+	case float64:
+		return value != 0, true
+	}
+
+	return false, false
+}
+
+// Records the error unless an earlier one was recorded already.
+func (instance *QuerySet) recordError(err error) *QuerySet {
+	if instance.Err == nil {
+		instance.Err = err
+	}
+
+	return instance
+}
+
+// Sets the projection option for a Find operation
+func (instance *QuerySet) Project(projection interface{}) *QuerySet {
+	instance.InitializeOptions()
+	instance.FindOptions = instance.FindOptions.SetProjection(projection)
+
+	return instance
+}
+
+// Sets the read preference of the operations, e.g. readpref.SecondaryPreferred()
+func (instance *QuerySet) ReadPreference(readPreference *readpref.ReadPref) *QuerySet {
+	if instance.CollectionOptions == nil {
+		instance.CollectionOptions = options.Collection()
+	}
+
+	instance.CollectionOptions = instance.CollectionOptions.SetReadPreference(readPreference)
+
+	return instance
+}
+
+// Reads from a secondary member when one is available, falls back to the primary otherwise.
+func (instance *QuerySet) ReadFromSecondary() *QuerySet {
+	return instance.ReadPreference(readpref.SecondaryPreferred())
+}
+
+// Sets the read concern of the read operations, e.g. readconcern.Majority()
+func (instance *QuerySet) ReadConcern(readConcern *readconcern.ReadConcern) *QuerySet {
+	if instance.CollectionOptions == nil {
+		instance.CollectionOptions = options.Collection()
+	}
+
+	instance.CollectionOptions = instance.CollectionOptions.SetReadConcern(readConcern)
+
+	return instance
+}
+
+// Sets the write concern of the write operations, e.g. writeconcern.Majority()
+func (instance *QuerySet) WriteConcern(writeConcern *writeconcern.WriteConcern) *QuerySet {
+	if instance.CollectionOptions == nil {
+		instance.CollectionOptions = options.Collection()
+	}
+
+	instance.CollectionOptions = instance.CollectionOptions.SetWriteConcern(writeConcern)
+
+	return instance
+}
+
+// Returns the named collection of the database, configured with the QuerySet's collection options.
+func (instance *QuerySet) Collection(database *mongo.Database, collectionName string) *mongo.Collection {
+	return database.Collection(collectionName, instance.CollectionOptions)
+}
+
+// Translates the Find options into options for a FindOne operation.
+// The limit is implied, the remaining options that apply to a single document are carried over.
+func (instance *QuerySet) FindOneOptions() *options.FindOneOptions {
+	findOneOptions := options.FindOne()
+
+	if instance.FindOptions == nil {
+		return findOneOptions
+	}
+
+	findOptions := instance.FindOptions
+
+	if findOptions.Projection != nil {
+		findOneOptions.SetProjection(findOptions.Projection)
+	}
+
+	if findOptions.Sort != nil {
+		findOneOptions.SetSort(findOptions.Sort)
+	}
+
+	if findOptions.Skip != nil {
+		findOneOptions.SetSkip(*findOptions.Skip)
+	}
+
+	if findOptions.Collation != nil {
+		findOneOptions.SetCollation(findOptions.Collation)
+	}
+
+	if findOptions.Hint != nil {
+		findOneOptions.SetHint(findOptions.Hint)
+	}
+
+	if findOptions.MaxTime != nil {
+		findOneOptions.SetMaxTime(*findOptions.MaxTime)
+	}
+
+	if findOptions.Comment != nil {
+		findOneOptions.SetComment(*findOptions.Comment)
+	}
+
+	if findOptions.AllowPartialResults != nil {
+		findOneOptions.SetAllowPartialResults(*findOptions.AllowPartialResults)
+	}
+
+	return findOneOptions
+}
+
+// Translates the Find and Update options into options for a FindOneAndUpdate operation.
+func (instance *QuerySet) FindOneAndUpdateOptions() *options.FindOneAndUpdateOptions {
+	findOneAndUpdateOptions := options.FindOneAndUpdate()
+	findOneAndUpdateOptions.ReturnDocument = instance.ReturnDocument
+
+	if instance.FindOptions != nil {
+		findOneAndUpdateOptions.Projection = instance.FindOptions.Projection
+		findOneAndUpdateOptions.Sort = instance.FindOptions.Sort
+		findOneAndUpdateOptions.Collation = instance.FindOptions.Collation
+		findOneAndUpdateOptions.Hint = instance.FindOptions.Hint
+		findOneAndUpdateOptions.MaxTime = instance.FindOptions.MaxTime
+	}
+
+	if instance.UpdateOptions != nil {
+		findOneAndUpdateOptions.Upsert = instance.UpdateOptions.Upsert
+		findOneAndUpdateOptions.ArrayFilters = instance.UpdateOptions.ArrayFilters
+		findOneAndUpdateOptions.BypassDocumentValidation = instance.UpdateOptions.BypassDocumentValidation
+		findOneAndUpdateOptions.Let = instance.UpdateOptions.Let
+
+		if instance.UpdateOptions.Collation != nil {
+			findOneAndUpdateOptions.Collation = instance.UpdateOptions.Collation
+		}
+
+		if instance.UpdateOptions.Hint != nil {
+			findOneAndUpdateOptions.Hint = instance.UpdateOptions.Hint
+		}
+	}
+
+	return findOneAndUpdateOptions
+}
+
+// Translates the Find and Delete options into options for a FindOneAndDelete operation.
+func (instance *QuerySet) FindOneAndDeleteOptions() *options.FindOneAndDeleteOptions {
+	findOneAndDeleteOptions := options.FindOneAndDelete()
+
+	if instance.FindOptions != nil {
+		findOneAndDeleteOptions.Projection = instance.FindOptions.Projection
+		findOneAndDeleteOptions.Sort = instance.FindOptions.Sort
+		findOneAndDeleteOptions.Collation = instance.FindOptions.Collation
+		findOneAndDeleteOptions.Hint = instance.FindOptions.Hint
+		findOneAndDeleteOptions.MaxTime = instance.FindOptions.MaxTime
+	}
+
+	if instance.DeleteOptions != nil {
+		findOneAndDeleteOptions.Let = instance.DeleteOptions.Let
+
+		if instance.DeleteOptions.Collation != nil {
+			findOneAndDeleteOptions.Collation = instance.DeleteOptions.Collation
+		}
+
+		if instance.DeleteOptions.Hint != nil {
+			findOneAndDeleteOptions.Hint = instance.DeleteOptions.Hint
+		}
+	}
+
+	return findOneAndDeleteOptions
+}
+
+// Translates the Update options into options for a ReplaceOne operation.
+func (instance *QuerySet) ReplaceOptions() *options.ReplaceOptions {
+	replaceOptions := options.Replace()
+
+	if instance.UpdateOptions != nil {
+		replaceOptions.Upsert = instance.UpdateOptions.Upsert
+		replaceOptions.BypassDocumentValidation = instance.UpdateOptions.BypassDocumentValidation
+		replaceOptions.Collation = instance.UpdateOptions.Collation
+		replaceOptions.Comment = instance.UpdateOptions.Comment
+		replaceOptions.Hint = instance.UpdateOptions.Hint
+		replaceOptions.Let = instance.UpdateOptions.Let
+	}
+
+	return replaceOptions
+}
+
+// Sorts the results of a Search() by relevance, exposing the relevance in the score field.
+// Replaces any previous sort, the score is added to any previous projection.
+func (instance *QuerySet) SortByTextScore() *QuerySet {
+	instance.InitializeOptions()
+	textScore := bson.M{"$meta": "textScore"}
+
+	projection := bson.M{}
+
+	if instance.FindOptions.Projection != nil {
+		raw, err := bson.Marshal(instance.FindOptions.Projection)
+
+		if err == nil {
+			_ = bson.Unmarshal(raw, &projection)
+		}
+	}
+
+	projection["score"] = textScore
+
+	instance.FindOptions = instance.FindOptions.
+		SetProjection(projection).
+		SetSort(bson.D{{Key: "score", Value: textScore}})
+
+	return instance
+}
+
+// Translates the Find options into options for a CountDocuments operation.
+// The skip and limit are left out so the count covers every matching document.
+func (instance *QuerySet) CountOptions() *options.CountOptions {
+	countOptions := options.Count()
+
+	if instance.FindOptions != nil {
+		countOptions.Collation = instance.FindOptions.Collation
+		countOptions.Hint = instance.FindOptions.Hint
+		countOptions.MaxTime = instance.FindOptions.MaxTime
+	}
+
+	return countOptions
+}
+
+// Initializes a QuerySet instance for an initial set of queries
+func CreateQuery(queries ...map[string]interface{}) *QuerySet {
+	var query QuerySet
+	query.Filter(queries...)
+
+	return &query
+}
+
+// Combines the filters and joins of the sets into a single flat AND chain, e.g. composing authorization filters.
+// Filters that are a lone $and are flattened into the chain. Options are not carried over,
+// the first error recorded by any of the sets is.
+func MergeQueries(sets ...*QuerySet) *QuerySet {
+	merged := CreateQuery()
+
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+
+		for _, query := range set.Query {
+			merged.Query = append(merged.Query, flattenAnd(query)...)
+		}
+
+		merged.Joins = append(merged.Joins, set.Joins...)
+
+		if set.Err != nil {
+			merged.recordError(set.Err)
+		}
+	}
+
+	return merged
+}
+
+// Splits a filter consisting of a lone $and into its, recursively flattened, filters.
+func flattenAnd(query map[string]interface{}) []map[string]interface{} {
+	if len(query) != 1 {
+		return []map[string]interface{}{query}
+	}
+
+	filters, ok := asArray(query["$and"])
+
+	if !ok {
+		return []map[string]interface{}{query}
+	}
+
+	flattened := make([]map[string]interface{}, 0, len(filters))
+
+	for _, filter := range filters {
+		document, ok := asDocument(filter)
+
+		if !ok {
+			return []map[string]interface{}{query}
+		}
+
+		flattened = append(flattened, flattenAnd(document)...)
+	}
+
+	return flattened
+}
+
+// Returned when a client supplied filter uses an operator running server-side JavaScript.
+var ErrUnsafeOperator = errors.New("mongodbutilities: filter uses a disallowed operator")
+
+// Operators rejected in client supplied filters.
+var unsafeOperators = map[string]bool{
+	"$where":       true,
+	"$function":    true,
+	"$accumulator": true,
+}
+
+// Initializes a QuerySet instance from a (relaxed extended) JSON filter, e.g. one received from a client.
+// Returns ErrUnsafeOperator if the filter uses $where, $function or $accumulator at any depth.
+func CreateQueryFromJSON(jsonStr string) (*QuerySet, error) {
+	filter := bson.M{}
+	err := bson.UnmarshalExtJSON([]byte(jsonStr), false, &filter)
+
+	if err != nil {
+		return nil, fmt.Errorf("mongodbutilities: invalid JSON filter: %w", err)
+	}
+
+	err = checkUnsafeOperators(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateQuery(filter), nil
+}
+
+// Walks the filter, returning ErrUnsafeOperator for the first unsafe operator found.
+func checkUnsafeOperators(value interface{}) error {
+	switch value := value.(type) {
+	case bson.M:
+		return checkUnsafeOperators(map[string]interface{}(value))
+	case map[string]interface{}:
+		for key, nested := range value {
+			if unsafeOperators[key] {
+				return fmt.Errorf("%w: %s", ErrUnsafeOperator, key)
+			}
+
+			err := checkUnsafeOperators(nested)
+
+			if err != nil {
+				return err
+			}
+		}
+	case bson.D:
+		for _, element := range value {
+			err := checkUnsafeOperators(bson.M{element.Key: element.Value})
+
+			if err != nil {
+				return err
+			}
+		}
+	case bson.A:
+		return checkUnsafeOperators([]interface{}(value))
+	case []interface{}:
+		for _, nested := range value {
+			err := checkUnsafeOperators(nested)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returned by Sanitize() when the filter queries a field missing from the allowlist.
+var ErrFieldNotAllowed = errors.New("mongodbutilities: filter field is not allowed")
+
+// Returned by Sanitize() when the filter uses an operator missing from the allowlist.
+var ErrOperatorNotAllowed = errors.New("mongodbutilities: filter operator is not allowed")
+
+// Operators combining whole filters, always allowed and walked into by Sanitize().
+var logicalOperators = map[string]bool{
+	"$and": true,
+	"$or":  true,
+	"$nor": true,
+}
+
+// Checks the accumulated filters against the allowed fields and operators, e.g. for client supplied filters.
+// $and, $or and $nor are walked into, plain equality on an allowed field needs no operator.
+// Join filters are built server-side and are not checked.
+func (instance *QuerySet) Sanitize(allowedFields []string, allowedOperators []string) error {
+	fields := make(map[string]bool, len(allowedFields))
+	operators := make(map[string]bool, len(allowedOperators))
+
+	for _, field := range allowedFields {
+		fields[field] = true
+	}
+
+	for _, operator := range allowedOperators {
+		operators[operator] = true
+	}
+
+	for _, query := range instance.Query {
+		err := sanitizeFilter(query, fields, operators)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks a filter document, i.e. one keyed by field names and logical operators.
+func sanitizeFilter(filter map[string]interface{}, fields, operators map[string]bool) error {
+	for key, value := range filter {
+		if logicalOperators[key] {
+			filters, ok := asArray(value)
+
+			if !ok {
+				return fmt.Errorf("%w: %s expects an array", ErrOperatorNotAllowed, key)
+			}
+
+			for _, nested := range filters {
+				document, ok := asDocument(nested)
+
+				if !ok {
+					return fmt.Errorf("%w: %s expects documents", ErrOperatorNotAllowed, key)
+				}
+
+				err := sanitizeFilter(document, fields, operators)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(key, "$") {
+			return fmt.Errorf("%w: %s", ErrOperatorNotAllowed, key)
+		}
+
+		if !fields[key] {
+			return fmt.Errorf("%w: %s", ErrFieldNotAllowed, key)
+		}
+
+		err := sanitizeExpression(value, fields, operators)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks the value a field is matched against, i.e. a literal or an operator document.
+// A regular expression literal matches like $regex and needs it allowed.
+func sanitizeExpression(value interface{}, fields, operators map[string]bool) error {
+	err := sanitizeRegex(value, operators)
+
+	if err != nil {
+		return err
+	}
+
+	document, ok := asDocument(value)
+
+	if !ok {
+		return nil
+	}
+
+	for key, operand := range document {
+		if !strings.HasPrefix(key, "$") {
+			// Equality against an embedded document.
+			continue
+		}
+
+		if !operators[key] {
+			return fmt.Errorf("%w: %s", ErrOperatorNotAllowed, key)
+		}
+
+		switch key {
+		case "$not":
+			err := sanitizeExpression(operand, fields, operators)
+
+			if err != nil {
+				return err
+			}
+		case "$in", "$nin", "$all":
+			elements, ok := asArray(operand)
+
+			if !ok {
+				continue
+			}
+
+			for _, element := range elements {
+				err := sanitizeRegex(element, operators)
+
+				if err != nil {
+					return err
+				}
+			}
+		case "$elemMatch":
+			nested, ok := asDocument(operand)
+
+			if !ok {
+				continue
+			}
+
+			err := sanitizeElemMatch(nested, fields, operators)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rejects a regular expression literal, e.g. primitive.Regex{Pattern: "^a"}, unless $regex is allowed.
+func sanitizeRegex(value interface{}, operators map[string]bool) error {
+	switch value.(type) {
+	case primitive.Regex, *primitive.Regex:
+		if !operators["$regex"] {
+			return fmt.Errorf("%w: $regex", ErrOperatorNotAllowed)
+		}
+	}
+
+	return nil
+}
+
+// Checks an $elemMatch operand, either operators on the elements or a filter on their fields.
+func sanitizeElemMatch(document map[string]interface{}, fields, operators map[string]bool) error {
+	for key := range document {
+		if strings.HasPrefix(key, "$") && !logicalOperators[key] {
+			return sanitizeExpression(document, fields, operators)
+		}
+	}
+
+	return sanitizeFilter(document, fields, operators)
+}
+
+// Returns the value as a document, if it is one.
+func asDocument(value interface{}) (map[string]interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return value, true
+	case bson.M:
+		return value, true
+	case bson.D:
+		document := make(map[string]interface{}, len(value))
+
+		for _, element := range value {
+			document[element.Key] = element.Value
+		}
+
+		return document, true
+	default:
+		return nil, false
+	}
+}
+
+// Returns the elements of the value, if it is a slice or an array.
+func asArray(value interface{}) ([]interface{}, bool) {
+	reflected := reflect.ValueOf(value)
+
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	elements := make([]interface{}, reflected.Len())
+
+	for i_ := range elements {
+		elements[i_] = reflected.Index(i_).Interface()
+	}
+
+	return elements, true
 }
 
 // Wrapper around the Skip() and Limit() methods. Emulates pagination.
@@ -198,333 +1393,4194 @@ func PaginateQuery(query *QuerySet, skip *int, limit *int) {
 		query.Skip(*skip)
 	}
 
-	if limit != nil {
-		query.Limit(*limit)
+	if limit != nil {
+		query.Limit(*limit)
+	}
+}
+
+// Emulates keyset pagination, retrieving the documents following afterValue when sorted by sortField.
+// A nil afterValue starts from the first page. Faster than skipping on large collections,
+// the sort field should be unique(e.g. _id) so no documents are skipped between pages.
+func PaginateAfter(query *QuerySet, sortField string, afterValue interface{}, limit int) {
+	if afterValue != nil {
+		query.Filter(bson.M{sortField: bson.M{"$gt": afterValue}})
+	}
+
+	query.Sort(bson.D{{Key: sortField, Value: 1}})
+	query.Limit(limit)
+}
+
+// Emulates a pipeline builder object that encompasses a sequence of aggregation stages
+type AggregateSet struct {
+	// Includes all the pipeline stages, in order
+	Stages []AggregateStage
+	// Additional options for the Aggregate() operation, to be passed along with the built pipeline.
+	AggregateOptions *options.AggregateOptions
+}
+
+// A single aggregation stage.
+// $match stages keep their QuerySet so the filter is built along with the pipeline.
+type AggregateStage struct {
+	Stage bson.D
+	Query *QuerySet
+}
+
+// Initializes an empty AggregateSet instance
+func CreateAggregate() *AggregateSet {
+	var aggregate AggregateSet
+
+	return &aggregate
+}
+
+// Lets the server spill large stages, e.g. $group or $sort, to disk instead of failing on its memory limit.
+func (instance *AggregateSet) AllowDiskUse(allowDiskUse bool) *AggregateSet {
+	if instance.AggregateOptions == nil {
+		instance.AggregateOptions = options.Aggregate()
+	}
+
+	instance.AggregateOptions = instance.AggregateOptions.SetAllowDiskUse(allowDiskUse)
+
+	return instance
+}
+
+// Adds a raw stage to the pipeline.
+func (instance *AggregateSet) AddStage(name string, value interface{}) *AggregateSet {
+	instance.Stages = append(instance.Stages, AggregateStage{
+		Stage: bson.D{{Key: name, Value: value}},
+	})
+
+	return instance
+}
+
+// Adds a $match stage filtering with the QuerySet.
+func (instance *AggregateSet) Match(query *QuerySet) *AggregateSet {
+	instance.Stages = append(instance.Stages, AggregateStage{Query: query})
+
+	return instance
+}
+
+// Adds a $group stage.
+func (instance *AggregateSet) Group(group bson.M) *AggregateSet {
+	return instance.AddStage("$group", group)
+}
+
+// Adds a $sort stage. Use a bson.D when sorting by several fields.
+func (instance *AggregateSet) Sort(sort interface{}) *AggregateSet {
+	return instance.AddStage("$sort", sort)
+}
+
+// Adds a $limit stage.
+func (instance *AggregateSet) Limit(limit int) *AggregateSet {
+	return instance.AddStage("$limit", int64(limit))
+}
+
+// Adds a $skip stage.
+func (instance *AggregateSet) Skip(skip int) *AggregateSet {
+	return instance.AddStage("$skip", int64(skip))
+}
+
+// Adds a $project stage.
+func (instance *AggregateSet) Project(projection interface{}) *AggregateSet {
+	return instance.AddStage("$project", projection)
+}
+
+// Adds a $lookup stage joining documents from another collection.
+func (instance *AggregateSet) Lookup(from, localField, foreignField, as string) *AggregateSet {
+	return instance.AddStage("$lookup", bson.M{
+		"from":         from,
+		"localField":   localField,
+		"foreignField": foreignField,
+		"as":           as,
+	})
+}
+
+// Adds an $addFields stage computing fields, e.g. bson.M{"fullName": bson.M{"$concat": bson.A{"$first", " ", "$last"}}}
+func (instance *AggregateSet) AddFields(fields bson.M) *AggregateSet {
+	return instance.AddStage("$addFields", fields)
+}
+
+// Alias of AddFields(), named after the $set stage alias of $addFields.
+func (instance *AggregateSet) Set(fields bson.M) *AggregateSet {
+	return instance.AddFields(fields)
+}
+
+// Adds an $unwind stage outputting a document per element of the array at path, e.g. "$orders".
+// preserveNullAndEmpty keeps documents whose array is missing or empty, giving left join semantics after Lookup().
+func (instance *AggregateSet) Unwind(path string, preserveNullAndEmpty bool) *AggregateSet {
+	if !strings.HasPrefix(path, "$") {
+		path = "$" + path
+	}
+
+	return instance.AddStage("$unwind", bson.M{
+		"path":                       path,
+		"preserveNullAndEmptyArrays": preserveNullAndEmpty,
+	})
+}
+
+// Build the final pipeline to be passed to an Aggregate() operation
+func (instance *AggregateSet) Build(database *mongo.Database) mongo.Pipeline {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return instance.BuildCtx(ctx, database)
+}
+
+// Build the final pipeline, building the $match filters within the provided context.
+// The $match stage of a QuerySet that recorded an error matches no document, see BuildCheckedCtx().
+func (instance *AggregateSet) BuildCtx(ctx context.Context, database *mongo.Database) mongo.Pipeline {
+	pipeline := make(mongo.Pipeline, len(instance.Stages))
+
+	for i_, stage := range instance.Stages {
+		if stage.Query != nil {
+			pipeline[i_] = bson.D{{Key: "$match", Value: stage.Query.BuildCtx(ctx, database)}}
+		} else {
+			pipeline[i_] = stage.Stage
+		}
+	}
+
+	return pipeline
+}
+
+// Build the final pipeline like Build(), failing with the first error of a $match stage's QuerySet.
+func (instance *AggregateSet) BuildChecked(database *mongo.Database) (mongo.Pipeline, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return instance.BuildCheckedCtx(ctx, database)
+}
+
+// Build the final pipeline within the provided context, failing with the first error of a $match stage's QuerySet.
+func (instance *AggregateSet) BuildCheckedCtx(ctx context.Context, database *mongo.Database) (mongo.Pipeline, error) {
+	pipeline := make(mongo.Pipeline, len(instance.Stages))
+
+	for i_, stage := range instance.Stages {
+		if stage.Query == nil {
+			pipeline[i_] = stage.Stage
+
+			continue
+		}
+
+		filter, err := stage.Query.BuildCheckedCtx(ctx, database)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pipeline[i_] = bson.D{{Key: "$match", Value: filter}}
+	}
+
+	return pipeline, nil
+}
+
+// Blueprint for a document that is to be stored in a collection.
+type BaseModel interface {
+	// Should be able to return the documents _id value
+	GetID() primitive.ObjectID
+	// Should be able to set the document's _id value.
+	SetID(primitive.ObjectID)
+}
+
+// Blueprint for a document keyed by an _id of another type than primitive.ObjectID, e.g. a UUID string.
+// See SaveModelG().
+type BaseModelKey[K comparable] interface {
+	// Should be able to return the documents _id value
+	GetID() K
+	// Should be able to set the document's _id value.
+	SetID(K)
+	// Should report whether the _id value is unset.
+	IsZeroID() bool
+}
+
+// Optional blueprint for a model that keeps track of its creation and update times.
+// SaveModel sets both timestamps on insertion and the update timestamp on update.
+type Timestamped interface {
+	// Should be able to set the document's creation time.
+	SetCreatedAt(time.Time)
+	// Should be able to set the document's last update time.
+	SetUpdatedAt(time.Time)
+}
+
+// Optional blueprint for a model that is marked as deleted instead of being removed.
+type SoftDeletable interface {
+	// Should be able to set the document's deletion time.
+	SetDeletedAt(time.Time)
+}
+
+// Optional blueprint for a model that validates itself before being saved.
+type Validatable interface {
+	// Should return an error when the model is not fit to be saved.
+	Validate() error
+}
+
+// Returned when a Versioned model was modified since it was read.
+var ErrStaleVersion = errors.New("mongodbutilities: document was modified by another writer")
+
+// Optional blueprint for a model protected against lost updates by a version stored in its version field.
+// SaveModel starts the version at 1 and only updates the document if its version is unchanged.
+type Versioned interface {
+	// Should be able to return the document's version.
+	GetVersion() int64
+	// Should be able to set the document's version.
+	SetVersion(int64)
+}
+
+// Optional blueprint for a model running logic before it is saved, an error aborts the save.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// Optional blueprint for a model running logic after it is saved.
+type AfterSaver interface {
+	AfterSave() error
+}
+
+// Optional blueprint for a model running logic before it is deleted, an error aborts the delete.
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+// Optional blueprint for a model running logic after it is deleted.
+type AfterDeleter interface {
+	AfterDelete() error
+}
+
+// Inserts/ Updates the model(document) in a collection.
+// Sets the _id value if its an insertion operation.
+// Sets the timestamps of models implementing Timestamped before they are written.
+// Models implementing Validatable are not written when they fail validation.
+// Updates of models implementing Versioned fail with ErrStaleVersion when the stored version changed.
+// Runs the BeforeSave() and AfterSave() hooks of models implementing them.
+func SaveModel(instance BaseModel, database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SaveModelCtx(ctx, instance, database, collectionName)
+}
+
+// Inserts/ Updates the model(document) in a collection within the provided context.
+func SaveModelCtx(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+) error {
+	_, err := saveModelWithHooks(ctx, instance, database, collectionName, false)
+
+	return err
+}
+
+// Inserts/ Updates the model(document) in a collection like SaveModel,
+// also reporting whether a document was created rather than updated.
+func SaveModelResult(instance BaseModel, database *mongo.Database, collectionName string) (bool, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SaveModelResultCtx(ctx, instance, database, collectionName)
+}
+
+// Inserts/ Updates the model(document) in a collection within the provided context,
+// reporting whether a document was created.
+func SaveModelResultCtx(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+) (bool, error) {
+	return saveModelWithHooks(ctx, instance, database, collectionName, false)
+}
+
+// Options of SaveModelResultWithOptions()
+type SaveOptions struct {
+	// Creates the document of a model whose _id is missing from the collection, unless it implements Versioned.
+	// Such an upserted document does not get a creation timestamp.
+	Upsert bool
+}
+
+// Inserts/ Updates the model(document) in a collection like SaveModelResult, with the provided options.
+func SaveModelResultWithOptions(
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+	saveOptions SaveOptions,
+) (bool, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SaveModelResultWithOptionsCtx(ctx, instance, database, collectionName, saveOptions)
+}
+
+// Inserts/ Updates the model(document) in a collection with the provided options, within the provided context.
+func SaveModelResultWithOptionsCtx(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+	saveOptions SaveOptions,
+) (bool, error) {
+	return saveModelWithHooks(ctx, instance, database, collectionName, saveOptions.Upsert)
+}
+
+// Returned by SaveModelG() when a model whose key is not a primitive.ObjectID has no key to be saved under.
+var ErrUnsetKey = errors.New("mongodbutilities: model key must be set before it is saved")
+
+// Inserts/ Updates a model(document) keyed by another type than primitive.ObjectID in a collection.
+// Models with an unset _id are inserted with a generated _id when K is primitive.ObjectID,
+// other keys such as UUIDs must be set before the first save, at the latest by BeforeSave(),
+// or ErrUnsetKey is returned.
+// Models with a set _id are updated, or inserted with their creation timestamp when no document has it.
+// Versioned ones are inserted while their version is 0 and updated with the same ErrStaleVersion
+// protection as SaveModel otherwise.
+// Runs the same validation, timestamps and hooks as SaveModel.
+func SaveModelG[K comparable](instance BaseModelKey[K], database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SaveModelGCtx(ctx, instance, database, collectionName)
+}
+
+// Inserts/ Updates a model(document) keyed by another type than primitive.ObjectID within the provided context.
+func SaveModelGCtx[K comparable](
+	ctx context.Context,
+	instance BaseModelKey[K],
+	database *mongo.Database,
+	collectionName string,
+) error {
+	if beforeSaver, isBeforeSaver := instance.(BeforeSaver); isBeforeSaver {
+		err := beforeSaver.BeforeSave()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Checked after BeforeSave(), which may set the key.
+	var zero K
+
+	if _, isObjectID := any(zero).(primitive.ObjectID); !isObjectID && instance.IsZeroID() {
+		return ErrUnsetKey
+	}
+
+	versioned, isVersioned := instance.(Versioned)
+	isNew := instance.IsZeroID() || (isVersioned && versioned.GetVersion() == 0)
+	filter, err := prepareDocument(instance, instance.GetID(), isNew)
+
+	if err != nil {
+		return err
+	}
+
+	if isNew {
+		res, err := InsertDocumentCtx(ctx, database, collectionName, instance)
+
+		if err != nil {
+			return err
+		}
+
+		id, isKey := res.InsertedID.(K)
+
+		if !isKey {
+			return fmt.Errorf("%w: the inserted _id %v is not a %T", ErrUnsetKey, res.InsertedID, zero)
+		}
+
+		instance.SetID(id)
+
+	} else {
+		res, err := UpdateDocumentCtx(ctx, database, collectionName, CreateQuery(filter), bson.M{"$set": instance})
+
+		if isVersioned && (err != nil || res.MatchedCount == 0) {
+			restoreVersion(instance)
+
+			if err == nil {
+				return ErrStaleVersion
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The key was set by the caller and no document has it yet, it is inserted with its creation timestamp.
+		if res.MatchedCount == 0 {
+			stampDocument(instance, nil, true)
+			_, err = InsertDocumentCtx(ctx, database, collectionName, instance)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if afterSaver, isAfterSaver := instance.(AfterSaver); isAfterSaver {
+		return afterSaver.AfterSave()
+	}
+
+	return nil
+}
+
+// Runs the save hooks around writing the model, reporting whether a document was created.
+func saveModelWithHooks(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+	upsert bool,
+) (bool, error) {
+	if beforeSaver, isBeforeSaver := instance.(BeforeSaver); isBeforeSaver {
+		err := beforeSaver.BeforeSave()
+
+		if err != nil {
+			return false, err
+		}
+	}
+
+	created, err := saveModel(ctx, instance, database, collectionName, upsert)
+
+	if err != nil {
+		return false, err
+	}
+
+	if afterSaver, isAfterSaver := instance.(AfterSaver); isAfterSaver {
+		return created, afterSaver.AfterSave()
+	}
+
+	return created, nil
+}
+
+// Validates and writes the model, without running the save hooks.
+// Updates of models not implementing Versioned upsert when upsert is set.
+func saveModel(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+	upsert bool,
+) (bool, error) {
+	filter, err := prepareModel(instance)
+
+	if err != nil {
+		return false, err
+	}
+
+	if instance.GetID() == primitive.NilObjectID {
+		res, err := InsertDocumentCtx(ctx, database, collectionName, instance)
+
+		if err != nil {
+			return false, err
+		}
+
+		instance.SetID(res.InsertedID.(primitive.ObjectID))
+
+		return true, nil
+
+	} else {
+		_, isVersioned := instance.(Versioned)
+		query := CreateQuery(filter)
+
+		if upsert && !isVersioned {
+			query.Upsert(true)
+		}
+
+		res, err := UpdateDocumentCtx(ctx, database, collectionName, query, bson.M{"$set": instance})
+
+		if isVersioned && (err != nil || res.MatchedCount == 0) {
+			restoreVersion(instance)
+
+			if err == nil {
+				return false, ErrStaleVersion
+			}
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		return res.UpsertedCount > 0, nil
+	}
+}
+
+// Validates the model and sets its timestamps and version ahead of a write.
+// Returns the filter matching the stored document when the model is to be updated.
+func prepareModel(instance BaseModel) (bson.M, error) {
+	return prepareDocument(instance, instance.GetID(), instance.GetID() == primitive.NilObjectID)
+}
+
+// Validates the model identified by id and sets its timestamps and version ahead of a write.
+// Returns the filter matching the stored document when the model is not new.
+func prepareDocument(instance interface{}, id interface{}, isNew bool) (bson.M, error) {
+	err := validateDocument(instance)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stampDocument(instance, id, isNew), nil
+}
+
+// Validates models implementing Validatable.
+func validateDocument(instance interface{}) error {
+	if validatable, isValidatable := instance.(Validatable); isValidatable {
+		return validatable.Validate()
+	}
+
+	return nil
+}
+
+// Sets the timestamps and version of the model identified by id ahead of a write.
+// Returns the filter matching the stored document when the model is not new.
+func stampDocument(instance interface{}, id interface{}, isNew bool) bson.M {
+	timestamped, isTimestamped := instance.(Timestamped)
+	versioned, isVersioned := instance.(Versioned)
+	now := time.Now()
+
+	if isNew {
+		if isTimestamped {
+			timestamped.SetCreatedAt(now)
+			timestamped.SetUpdatedAt(now)
+		}
+
+		if isVersioned {
+			versioned.SetVersion(1)
+		}
+
+		return nil
+	}
+
+	if isTimestamped {
+		timestamped.SetUpdatedAt(now)
+	}
+
+	filter := bson.M{"_id": id}
+
+	// The incremented version is written along with the rest of the document.
+	if isVersioned {
+		version := versioned.GetVersion()
+		filter["version"] = version
+		versioned.SetVersion(version + 1)
+	}
+
+	return filter
+}
+
+// Reverts the version increment of a Versioned model whose update did not go through.
+func restoreVersion(instance interface{}) {
+	if versioned, isVersioned := instance.(Versioned); isVersioned {
+		versioned.SetVersion(versioned.GetVersion() - 1)
+	}
+}
+
+// Returns how many documents an ordered InsertMany wrote before failing with err,
+// i.e. those before the first write error. None are known to be written without write errors to go by.
+func insertedPrefix(err error, count int) int {
+	var bulkError mongo.BulkWriteException
+
+	if !errors.As(err, &bulkError) {
+		return 0
+	}
+
+	written := count
+
+	for _, writeError := range bulkError.WriteErrors {
+		if writeError.Index < written {
+			written = writeError.Index
+		}
+	}
+
+	return written
+}
+
+// Inserts/ Updates the models(documents) in a collection in at most two round trips.
+// New models are inserted together and have their _id values set,
+// existing ones are updated together in a single bulk write.
+// Runs the same validation, timestamps, versioning and hooks as SaveModel,
+// failing with ErrStaleVersion when any of the updated Versioned models was modified.
+// Only the models whose write did not go through have their version increment reverted,
+// the models inserted before a failed insert keep their _id values while the updates are not sent.
+func SaveModels(instances []BaseModel, database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SaveModelsCtx(ctx, instances, database, collectionName)
+}
+
+// Inserts/ Updates the models(documents) in a collection within the provided context.
+func SaveModelsCtx(
+	ctx context.Context,
+	instances []BaseModel,
+	database *mongo.Database,
+	collectionName string,
+) error {
+	var inserts []BaseModel
+	var updates []BaseModel
+	var versionedUpdates []BaseModel
+	bulk := CreateBulk()
+
+	// Every model is validated before any version is incremented, an invalid one leaves the batch untouched.
+	for _, instance := range instances {
+		if beforeSaver, isBeforeSaver := instance.(BeforeSaver); isBeforeSaver {
+			err := beforeSaver.BeforeSave()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		err := validateDocument(instance)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, instance := range instances {
+		isNew := instance.GetID() == primitive.NilObjectID
+		filter := stampDocument(instance, instance.GetID(), isNew)
+
+		if isNew {
+			inserts = append(inserts, instance)
+		} else {
+			if _, isVersioned := instance.(Versioned); isVersioned {
+				versionedUpdates = append(versionedUpdates, instance)
+			}
+
+			updates = append(updates, instance)
+			bulk.UpdateOne(CreateQuery(filter), bson.M{"$set": instance})
+		}
+	}
+
+	if len(inserts) > 0 {
+		res, err := InsertDocumentsTypedCtx(ctx, database, collectionName, inserts)
+
+		if err != nil {
+			written := 0
+
+			if res != nil {
+				written = insertedPrefix(err, len(inserts))
+			}
+
+			// The models inserted before the failure keep their _id values, so retrying does not duplicate them.
+			for i_, instance := range inserts {
+				if i_ < written {
+					instance.SetID(res.InsertedIDs[i_].(primitive.ObjectID))
+				} else {
+					restoreVersion(instance)
+				}
+			}
+
+			// The updates were not sent, none of their versions was written.
+			for _, instance := range updates {
+				restoreVersion(instance)
+			}
+
+			return err
+		}
+
+		for i_, instance := range inserts {
+			instance.SetID(res.InsertedIDs[i_].(primitive.ObjectID))
+		}
+	}
+
+	if len(updates) > 0 {
+		res, err := bulk.ExecuteCtx(ctx, database, collectionName)
+
+		if err != nil || (len(versionedUpdates) > 0 && res.MatchedCount < int64(len(updates))) {
+			err = restoreUnwrittenVersions(ctx, database, collectionName, versionedUpdates, err)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, instance := range instances {
+		if afterSaver, isAfterSaver := instance.(AfterSaver); isAfterSaver {
+			err := afterSaver.AfterSave()
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reverts the version increments of the Versioned models whose update did not go through, those whose
+// stored version differs from theirs. Returns the error of the write, or ErrStaleVersion when it succeeded
+// but some models were modified. Versions that cannot be read back are all reverted.
+func restoreUnwrittenVersions(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	instances []BaseModel,
+	writeErr error,
+) error {
+	ids := make([]primitive.ObjectID, len(instances))
+
+	for i_, instance := range instances {
+		ids[i_] = instance.GetID()
+	}
+
+	query := CreateQuery(bson.M{"_id": bson.M{"$in": ids}}).Project(bson.M{"version": 1})
+	stored, err := GetDocumentsTypedCtx[struct {
+		ID      primitive.ObjectID `bson:"_id"`
+		Version int64              `bson:"version"`
+	}](ctx, database, collectionName, query)
+
+	if err != nil {
+		for _, instance := range instances {
+			restoreVersion(instance)
+		}
+
+		if writeErr != nil {
+			return writeErr
+		}
+
+		return err
+	}
+
+	versions := make(map[primitive.ObjectID]int64, len(stored))
+
+	for _, document := range stored {
+		versions[document.ID] = document.Version
+	}
+
+	stale := false
+
+	for _, instance := range instances {
+		version, ok := versions[instance.GetID()]
+
+		if !ok || version != instance.(Versioned).GetVersion() {
+			restoreVersion(instance)
+			stale = true
+		}
+	}
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if stale {
+		return ErrStaleVersion
+	}
+
+	return nil
+}
+
+// Deletes the model(document) from a collection.
+// Runs the BeforeDelete() and AfterDelete() hooks of models implementing them.
+func DeleteModel(instance BaseModel, database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteModelCtx(ctx, instance, database, collectionName)
+}
+
+// Deletes the model(document) from a collection within the provided context.
+func DeleteModelCtx(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+) error {
+	if instance.GetID() == primitive.NilObjectID {
+		return nil
+
+	} else {
+		err := beforeDelete(instance)
+
+		if err != nil {
+			return err
+		}
+
+		var query QuerySet
+		query.Filter(bson.M{"_id": instance.GetID()})
+		_, err = DeleteDocumentCtx(
+			ctx,
+			database,
+			collectionName,
+			&query,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		return afterDelete(instance)
+	}
+}
+
+// Runs the BeforeDelete() hook of models implementing it.
+func beforeDelete(instance BaseModel) error {
+	if beforeDeleter, isBeforeDeleter := instance.(BeforeDeleter); isBeforeDeleter {
+		return beforeDeleter.BeforeDelete()
+	}
+
+	return nil
+}
+
+// Runs the AfterDelete() hook of models implementing it.
+func afterDelete(instance BaseModel) error {
+	if afterDeleter, isAfterDeleter := instance.(AfterDeleter); isAfterDeleter {
+		return afterDeleter.AfterDelete()
+	}
+
+	return nil
+}
+
+// Marks the model(document) as deleted by setting its deleted and deleted_at fields.
+// Models not implementing SoftDeletable are deleted from the collection.
+func DeleteModelSoft(instance BaseModel, database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteModelSoftCtx(ctx, instance, database, collectionName)
+}
+
+// Marks the model(document) as deleted within the provided context.
+func DeleteModelSoftCtx(
+	ctx context.Context,
+	instance BaseModel,
+	database *mongo.Database,
+	collectionName string,
+) error {
+	softDeletable, isSoftDeletable := instance.(SoftDeletable)
+
+	if !isSoftDeletable {
+		return DeleteModelCtx(ctx, instance, database, collectionName)
+	}
+
+	if instance.GetID() == primitive.NilObjectID {
+		return nil
+	}
+
+	err := beforeDelete(instance)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	softDeletable.SetDeletedAt(now)
+
+	var query QuerySet
+	query.Filter(bson.M{"_id": instance.GetID()})
+	_, err = UpdateDocumentCtx(
+		ctx,
+		database,
+		collectionName,
+		&query,
+		bson.M{"$set": bson.M{"deleted": true, "deleted_at": now}},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return afterDelete(instance)
+}
+
+// Typed access to the models(documents) of a single collection.
+// PT is the pointer type implementing BaseModel, it is inferred: CreateRepository[User](database, "users")
+type Repository[T any, PT interface {
+	*T
+	BaseModel
+}] struct {
+	Database       *mongo.Database
+	CollectionName string
+}
+
+// Initializes a Repository instance bound to the collection
+func CreateRepository[T any, PT interface {
+	*T
+	BaseModel
+}](database *mongo.Database, collectionName string) *Repository[T, PT] {
+	return &Repository[T, PT]{Database: database, CollectionName: collectionName}
+}
+
+// Inserts/ Updates the model in the collection(see SaveModel())
+func (instance *Repository[T, PT]) Save(model *T) error {
+	return SaveModel(PT(model), instance.Database, instance.CollectionName)
+}
+
+// Inserts/ Updates the model in the collection within the provided context.
+func (instance *Repository[T, PT]) SaveCtx(ctx context.Context, model *T) error {
+	return SaveModelCtx(ctx, PT(model), instance.Database, instance.CollectionName)
+}
+
+// Deletes the model from the collection(see DeleteModel())
+func (instance *Repository[T, PT]) Delete(model *T) error {
+	return DeleteModel(PT(model), instance.Database, instance.CollectionName)
+}
+
+// Deletes the model from the collection within the provided context.
+func (instance *Repository[T, PT]) DeleteCtx(ctx context.Context, model *T) error {
+	return DeleteModelCtx(ctx, PT(model), instance.Database, instance.CollectionName)
+}
+
+// Retrieves the model with the _id value, no model and no error when none is found.
+func (instance *Repository[T, PT]) FindByID(id primitive.ObjectID) (*T, error) {
+	return GetDocumentByID[T](instance.Database, instance.CollectionName, id)
+}
+
+// Retrieves the model with the _id value within the provided context.
+func (instance *Repository[T, PT]) FindByIDCtx(ctx context.Context, id primitive.ObjectID) (*T, error) {
+	return GetDocumentByIDCtx[T](ctx, instance.Database, instance.CollectionName, id)
+}
+
+// Retrieves the first model matching the query, no model and no error when none is found.
+func (instance *Repository[T, PT]) FindOne(query *QuerySet) (*T, error) {
+	return GetDocumentTyped[T](instance.Database, instance.CollectionName, query)
+}
+
+// Retrieves the first model matching the query within the provided context.
+func (instance *Repository[T, PT]) FindOneCtx(ctx context.Context, query *QuerySet) (*T, error) {
+	return GetDocumentTypedCtx[T](ctx, instance.Database, instance.CollectionName, query)
+}
+
+// Retrieves all the models matching the query.
+func (instance *Repository[T, PT]) Find(query *QuerySet) ([]T, error) {
+	return GetDocumentsTyped[T](instance.Database, instance.CollectionName, query)
+}
+
+// Retrieves all the models matching the query within the provided context.
+func (instance *Repository[T, PT]) FindCtx(ctx context.Context, query *QuerySet) ([]T, error) {
+	return GetDocumentsTypedCtx[T](ctx, instance.Database, instance.CollectionName, query)
+}
+
+// Counts the models matching the query.
+func (instance *Repository[T, PT]) Count(query *QuerySet) (int64, error) {
+	return CountDocuments(instance.Database, instance.CollectionName, query)
+}
+
+// Counts the models matching the query within the provided context.
+func (instance *Repository[T, PT]) CountCtx(ctx context.Context, query *QuerySet) (int64, error) {
+	return CountDocumentsCtx(ctx, instance.Database, instance.CollectionName, query)
+}
+
+// Returned, wrapping the driver error, when the database server cannot be reached in time.
+var ErrConnectionTimeout = errors.New("mongodbutilities: timed out connecting to the database")
+
+// Returned, wrapping the driver error, when the database host cannot be resolved.
+var ErrHostNotFound = errors.New("mongodbutilities: database host could not be resolved")
+
+// Returned, wrapping the driver error, when the database server rejects the credentials.
+var ErrAuthentication = errors.New("mongodbutilities: database authentication failed")
+
+// Initializes a Mongodb database connection from a URI and a database name
+// The connection is verified within DefaultTimeout.
+func GetDatabase(url, name string) (*mongo.Database, error) {
+	return GetDatabaseWithTimeout(url, name, DefaultTimeout)
+}
+
+// Initializes a Mongodb database connection, verifying it within the timeout.
+func GetDatabaseWithTimeout(url, name string, timeout time.Duration) (*mongo.Database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	defer cancel()
+
+	return GetDatabaseCtx(ctx, url, name)
+}
+
+// Initializes a Mongodb database connection, verifying it within the provided context.
+// Failures are wrapped with ErrHostNotFound, ErrAuthentication or ErrConnectionTimeout when recognized.
+func GetDatabaseCtx(ctx context.Context, url, name string) (*mongo.Database, error) {
+	return GetDatabaseWithOptionsCtx(ctx, url, name, options.Client())
+}
+
+// Initializes a Mongodb database connection with custom client options(TLS, credentials, pool sizes...)
+// Options set on clientOptions take precedence over the ones in the URI.
+func GetDatabaseWithOptions(
+	url, name string,
+	clientOptions *options.ClientOptions,
+) (*mongo.Database, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDatabaseWithOptionsCtx(ctx, url, name, clientOptions)
+}
+
+// Initializes a Mongodb database connection with custom client options within the provided context.
+func GetDatabaseWithOptionsCtx(
+	ctx context.Context,
+	url, name string,
+	clientOptions *options.ClientOptions,
+) (*mongo.Database, error) {
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url), clientOptions)
+
+	if err != nil {
+		return nil, classifyConnectionError(err)
+
+	}
+
+	err = client.Ping(ctx, nil)
+
+	if err != nil {
+		_ = client.Disconnect(context.Background())
+
+		return nil, classifyConnectionError(err)
+	}
+
+	return client.Database(name), nil
+}
+
+// A client shared by GetSharedDatabase(), its lock serializes the connections to its url.
+type sharedClient struct {
+	sync.Mutex
+	client *mongo.Client
+}
+
+// Clients shared by GetSharedDatabase(), keyed by connection URL.
+// The lock only guards the map, so connecting to a url never blocks the others.
+var sharedClients = struct {
+	sync.Mutex
+	clients map[string]*sharedClient
+}{clients: make(map[string]*sharedClient)}
+
+// Returns a database on a process-wide client for the url, connecting only when no healthy client exists.
+// Suited to environments calling it on every invocation, e.g. serverless functions.
+// Closing the returned database disconnects the client for all its users, the next call reconnects.
+func GetSharedDatabase(url, name string) (*mongo.Database, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetSharedDatabaseCtx(ctx, url, name)
+}
+
+// Returns a database on a process-wide client for the url within the provided context.
+func GetSharedDatabaseCtx(ctx context.Context, url, name string) (*mongo.Database, error) {
+	sharedClients.Lock()
+	entry, ok := sharedClients.clients[url]
+
+	if !ok {
+		entry = &sharedClient{}
+		sharedClients.clients[url] = entry
+	}
+
+	sharedClients.Unlock()
+
+	entry.Lock()
+
+	defer entry.Unlock()
+
+	if entry.client != nil {
+		if entry.client.Ping(ctx, nil) == nil {
+			return entry.client.Database(name), nil
+		}
+
+		_ = entry.client.Disconnect(context.Background())
+		entry.client = nil
+	}
+
+	database, err := GetDatabaseCtx(ctx, url, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry.client = database.Client()
+
+	return database, nil
+}
+
+// Wraps a connection error with the package error describing its cause.
+func classifyConnectionError(err error) error {
+	causes := []error{err}
+
+	var selectionError topology.ServerSelectionError
+	if errors.As(err, &selectionError) {
+		for _, server := range selectionError.Desc.Servers {
+			if server.LastError != nil {
+				causes = append(causes, server.LastError)
+			}
+		}
+	}
+
+	for _, cause := range causes {
+		var dnsError *net.DNSError
+		if errors.As(cause, &dnsError) {
+			return fmt.Errorf("%w: %w", ErrHostNotFound, err)
+		}
+
+		var authError *auth.Error
+		if errors.As(cause, &authError) {
+			return fmt.Errorf("%w: %w", ErrAuthentication, err)
+		}
+	}
+
+	if mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrConnectionTimeout, err)
+	}
+
+	return err
+}
+
+// Verifies the database's server is reachable within the timeout.
+func PingDatabase(database *mongo.Database, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	defer cancel()
+
+	return PingDatabaseCtx(ctx, database)
+}
+
+// Verifies the database's server is reachable within the provided context.
+func PingDatabaseCtx(ctx context.Context, database *mongo.Database) error {
+	return database.Client().Ping(ctx, nil)
+}
+
+// Disconnects the client behind the database within the timeout.
+// Other databases sharing the same client are disconnected as well.
+func CloseDatabase(database *mongo.Database, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	defer cancel()
+
+	return CloseDatabaseCtx(ctx, database)
+}
+
+// Disconnects the client behind the database within the provided context.
+func CloseDatabaseCtx(ctx context.Context, database *mongo.Database) error {
+	return database.Client().Disconnect(ctx)
+}
+
+// Runs fn inside a transaction, committing it when fn succeeds and aborting it otherwise.
+// Pass the session context to the Ctx variants of the helpers so they take part in the transaction.
+func WithTransaction(database *mongo.Database, fn func(ctx mongo.SessionContext) error) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return WithTransactionCtx(ctx, database, fn)
+}
+
+// Runs fn inside a transaction within the provided context.
+func WithTransactionCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	fn func(ctx mongo.SessionContext) error,
+) error {
+	session, err := database.Client().StartSession()
+
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessionContext mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionContext)
+	})
+
+	return err
+}
+
+// Helper function for an InsertOne operation.
+func InsertDocument(
+	database *mongo.Database,
+	collectionName string,
+	document interface{},
+) (*mongo.InsertOneResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return InsertDocumentCtx(ctx, database, collectionName, document)
+}
+
+// Helper function for an InsertOne operation with per call options.
+func InsertDocumentOpts(
+	database *mongo.Database,
+	collectionName string,
+	document interface{},
+	opts OpOptions,
+) (*mongo.InsertOneResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return InsertDocumentCtx(ctx, opts.configure(database), collectionName, document)
+}
+
+// Helper function for an InsertOne operation within the provided context.
+func InsertDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	document interface{},
+) (*mongo.InsertOneResult, error) {
+	collection := database.Collection(collectionName)
+	res, err := collection.InsertOne(ctx, document)
+
+	return res, wrapError("InsertOne", collectionName, err)
+}
+
+// Helper function for an InsertMany operation.
+func InsertDocuments(
+	database *mongo.Database,
+	collectionName string,
+	document []interface{},
+) (*mongo.InsertManyResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return InsertDocumentsCtx(ctx, database, collectionName, document)
+}
+
+// Helper function for an InsertMany operation with per call options.
+func InsertDocumentsOpts(
+	database *mongo.Database,
+	collectionName string,
+	document []interface{},
+	opts OpOptions,
+) (*mongo.InsertManyResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return InsertDocumentsCtx(ctx, opts.configure(database), collectionName, document)
+}
+
+// Helper function for an InsertMany operation within the provided context.
+func InsertDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	document []interface{},
+) (*mongo.InsertManyResult, error) {
+	collection := database.Collection(collectionName)
+	res, err := collection.InsertMany(ctx, document)
+
+	return res, wrapError("InsertMany", collectionName, err)
+}
+
+// Helper function for an InsertMany operation on a typed slice of documents.
+func InsertDocumentsTyped[T any](
+	database *mongo.Database,
+	collectionName string,
+	documents []T,
+) (*mongo.InsertManyResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return InsertDocumentsTypedCtx(ctx, database, collectionName, documents)
+}
+
+// Helper function for an InsertMany operation on a typed slice within the provided context.
+func InsertDocumentsTypedCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	documents []T,
+) (*mongo.InsertManyResult, error) {
+	entries := make([]interface{}, len(documents))
+
+	for i_, document := range documents {
+		entries[i_] = document
+	}
+
+	return InsertDocumentsCtx(ctx, database, collectionName, entries)
+}
+
+// Wraps a driver error with the operation and the collection it failed on, errors.Is() and errors.As()
+// still see the driver error. No error is left as is.
+func wrapError(operation, collectionName string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("mongodbutilities: %s on %q: %w", operation, collectionName, err)
+}
+
+// Checks whether the error is a duplicate key error(code 11000), raised when a unique index rejects a write.
+func IsDuplicateKeyError(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// Server error codes reporting conditions(elections, shutdowns, network failures) that clear up on their own.
+var transientErrorCodes = []int{6, 7, 89, 91, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
+// Checks whether the error is transient(network error, primary step down...) and the operation worth retrying.
+// Cancelled and expired contexts are not transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) {
+		if serverError.HasErrorLabel("RetryableWriteError") ||
+			serverError.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+
+		for _, code := range transientErrorCodes {
+			if serverError.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returned when a retry is requested with fewer than 1 attempt, fn is then never called.
+var ErrInvalidAttempts = errors.New("mongodbutilities: retry attempts must be greater than 0")
+
+// Runs fn up to attempts times while it fails with a transient error(see IsTransient())
+// Waits backoff before the first retry, doubling the wait on every following one.
+// Returns ErrInvalidAttempts, without calling fn, when attempts is smaller than 1.
+func WithRetry(attempts int, backoff time.Duration, fn func() error) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return WithRetryCtx(ctx, attempts, backoff, fn)
+}
+
+// Runs fn up to attempts times while it fails with a transient error, no longer waiting once the context is done.
+func WithRetryCtx(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	if attempts < 1 {
+		return ErrInvalidAttempts
+	}
+
+	var err error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+		}
+
+		err = fn()
+
+		if !IsTransient(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// The driver error for a single document operation that matched no document.
+// The helpers returning a single document report it as no document and no error instead,
+// it only surfaces when decoding a *mongo.SingleResult obtained elsewhere.
+var ErrNotFound = mongo.ErrNoDocuments
+
+// Checks whether the error reports that no document matched.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// Maps a single document result holding ErrNotFound to no result and no error,
+// the convention of every helper returning a single document.
+func checkSingleResult(res *mongo.SingleResult) (*mongo.SingleResult, error) {
+	if res.Err() != nil {
+		if IsNotFound(res.Err()) {
+			return nil, nil
+		}
+
+		return nil, res.Err()
+	}
+
+	return res, nil
+}
+
+// Decodes the document of a single document result, obtained from the helpers or the raw collection.
+// Returns no document and no error for a nil result or one holding ErrNotFound.
+func DecodeSingle[T any](res *mongo.SingleResult) (*T, error) {
+	if res == nil {
+		return nil, nil
+	}
+
+	res, err := checkSingleResult(res)
+
+	if res == nil || err != nil {
+		return nil, err
+	}
+
+	var document T
+	err = res.Decode(&document)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+// Helper function for a FindOne operation.
+// Return no error in the case of no document found.
+// Utilizes the QuerySet abstraction, honoring its projection, sort and skip.
+func GetDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.SingleResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a FindOne operation within the provided context.
+func GetDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.SingleResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res := collection.FindOne(ctx, query.BuildCtx(ctx, database), query.FindOneOptions())
+
+	res, err = checkSingleResult(res)
+
+	return res, wrapError("FindOne", collectionName, err)
+}
+
+// Helper function for a FindOne operation, decoding the document found.
+// Returns no document and no error in the case of no document found.
+func GetDocumentTyped[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentTypedCtx[T](ctx, database, collectionName, query)
+}
+
+// Helper function for a decoded FindOne operation with per call options.
+func GetDocumentTypedOpts[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	opts OpOptions,
+) (*T, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return GetDocumentTypedCtx[T](ctx, database, collectionName, query)
+}
+
+// Helper function for a decoded FindOne operation within the provided context.
+func GetDocumentTypedCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*T, error) {
+	res, err := GetDocumentCtx(ctx, database, collectionName, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeSingle[T](res)
+}
+
+// Helper function for retrieving the decoded document with the _id value.
+// Returns no document and no error in the case of no document found.
+func GetDocumentByID[T any](
+	database *mongo.Database,
+	collectionName string,
+	id primitive.ObjectID,
+) (*T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentByIDCtx[T](ctx, database, collectionName, id)
+}
+
+// Helper function for retrieving the decoded document with the _id value within the provided context.
+func GetDocumentByIDCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	id primitive.ObjectID,
+) (*T, error) {
+	return GetDocumentTypedCtx[T](ctx, database, collectionName, CreateQuery(bson.M{"_id": id}))
+}
+
+// Helper function for retrieving the decoded document with the hex encoded _id value.
+// Fails for malformed hex values.
+func GetDocumentByHexID[T any](
+	database *mongo.Database,
+	collectionName string,
+	hexID string,
+) (*T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentByHexIDCtx[T](ctx, database, collectionName, hexID)
+}
+
+// Helper function for retrieving the decoded document with the hex encoded _id value within the provided context.
+func GetDocumentByHexIDCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	hexID string,
+) (*T, error) {
+	id, err := primitive.ObjectIDFromHex(hexID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return GetDocumentByIDCtx[T](ctx, database, collectionName, id)
+}
+
+// Helper function for retrieving the decoded documents with the _id values, in the order of the values.
+// Values matching no document are skipped.
+func GetDocumentsByIDs[T any](
+	database *mongo.Database,
+	collectionName string,
+	ids []primitive.ObjectID,
+) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentsByIDsCtx[T](ctx, database, collectionName, ids)
+}
+
+// Helper function for retrieving the decoded documents with the _id values within the provided context.
+func GetDocumentsByIDsCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	ids []primitive.ObjectID,
+) ([]T, error) {
+	if len(ids) == 0 {
+		return []T{}, nil
+	}
+
+	query := CreateQuery(bson.M{"_id": bson.M{"$in": ids}})
+	raws, err := GetDocumentsTypedCtx[bson.Raw](ctx, database, collectionName, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[primitive.ObjectID]bson.Raw, len(raws))
+
+	for _, raw := range raws {
+		if id, ok := raw.Lookup("_id").ObjectIDOK(); ok {
+			found[id] = raw
+		}
+	}
+
+	documents := make([]T, 0, len(found))
+
+	for _, id := range ids {
+		raw, ok := found[id]
+
+		if !ok {
+			continue
+		}
+
+		var document T
+		err = bson.Unmarshal(raw, &document)
+
+		if err != nil {
+			return nil, err
+		}
+
+		documents = append(documents, document)
+	}
+
+	return documents, nil
+}
+
+// Helper function for a Find() operation.
+// Utilizes the QuerySet abstraction.
+func GetDocuments(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.Cursor, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a Find() operation within the provided context.
+func GetDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.Cursor, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+
+	if query.FindOptions != nil {
+		res, err := collection.Find(ctx, query.BuildCtx(ctx, database), query.FindOptions)
+
+		return res, wrapError("Find", collectionName, err)
+
+	} else {
+		res, err := collection.Find(ctx, query.BuildCtx(ctx, database))
+
+		return res, wrapError("Find", collectionName, err)
+	}
+}
+
+// Drains the cursor into a slice of decoded documents and closes it.
+func DecodeAll[T any](cursor *mongo.Cursor) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DecodeAllCtx[T](ctx, cursor)
+}
+
+// Drains the cursor into a slice of decoded documents within the provided context.
+// The cursor is closed even when decoding fails.
+func DecodeAllCtx[T any](ctx context.Context, cursor *mongo.Cursor) ([]T, error) {
+	defer cursor.Close(ctx)
+
+	results := []T{}
+	err := cursor.All(ctx, &results)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Helper function for a Find() operation, decoding all the documents found.
+// Utilizes the QuerySet abstraction.
+func GetDocumentsTyped[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentsTypedCtx[T](ctx, database, collectionName, query)
+}
+
+// Helper function for a decoded Find() operation with per call options.
+func GetDocumentsTypedOpts[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	opts OpOptions,
+) ([]T, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return GetDocumentsTypedCtx[T](ctx, database, collectionName, query)
+}
+
+// Helper function for a decoded Find() operation within the provided context.
+func GetDocumentsTypedCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) ([]T, error) {
+	cursor, err := GetDocumentsCtx(ctx, database, collectionName, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeAllCtx[T](ctx, cursor)
+}
+
+// Helper function for a Find() operation, decoding and handing the documents to fn one at a time.
+// Stops at the first error returned by fn, the cursor is closed in every case.
+func StreamDocuments[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fn func(T) error,
+) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return StreamDocumentsCtx(ctx, database, collectionName, query, fn)
+}
+
+// Helper function for a streamed Find() operation within the provided context.
+func StreamDocumentsCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fn func(T) error,
+) error {
+	cursor, err := GetDocumentsCtx(ctx, database, collectionName, query)
+
+	if err != nil {
+		return err
+	}
+
+	return StreamCursorCtx(ctx, cursor, fn)
+}
+
+// Decodes and hands the cursor's documents to fn one at a time.
+// Stops at the first error returned by fn, the cursor is closed in every case.
+func StreamCursor[T any](cursor *mongo.Cursor, fn func(T) error) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return StreamCursorCtx(ctx, cursor, fn)
+}
+
+// Decodes and hands the cursor's documents to fn one at a time within the provided context.
+func StreamCursorCtx[T any](ctx context.Context, cursor *mongo.Cursor, fn func(T) error) error {
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var document T
+		err := cursor.Decode(&document)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(document)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+// Returned when a page is requested with a page size smaller than 1.
+var ErrInvalidPageSize = errors.New("mongodbutilities: page size must be greater than 0")
+
+// A single page of decoded documents along with the pagination metadata.
+type PaginatedResult[T any] struct {
+	Items      []T
+	Total      int64
+	Page       int
+	PageSize   int
+	TotalPages int
+	// Whether Total is an estimate, see PaginateOptions.
+	Approximate bool
+}
+
+// Options of PaginateWithOptions()
+type PaginateOptions struct {
+	// Estimates the total from the collection metadata when the QuerySet has no filters,
+	// trading accuracy for speed on large collections. Filtered totals are always exact.
+	Approximate bool
+}
+
+// Retrieves a page(starting from 1) of decoded documents, counting the total with the same filter.
+// The QuerySet's own skip and limit are ignored and left untouched.
+func Paginate[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	page, pageSize int,
+) (*PaginatedResult[T], error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PaginateCtx[T](ctx, database, collectionName, query, page, pageSize)
+}
+
+// Retrieves a page of decoded documents within the provided context.
+func PaginateCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	page, pageSize int,
+) (*PaginatedResult[T], error) {
+	return PaginateWithOptionsCtx[T](ctx, database, collectionName, query, page, pageSize, PaginateOptions{})
+}
+
+// Retrieves a page(starting from 1) of decoded documents like Paginate(), with the pagination options.
+func PaginateWithOptions[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	page, pageSize int,
+	paginateOptions PaginateOptions,
+) (*PaginatedResult[T], error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PaginateWithOptionsCtx[T](ctx, database, collectionName, query, page, pageSize, paginateOptions)
+}
+
+// Retrieves a page of decoded documents with the pagination options within the provided context.
+func PaginateWithOptionsCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	page, pageSize int,
+	paginateOptions PaginateOptions,
+) (*PaginatedResult[T], error) {
+	if pageSize < 1 {
+		return nil, ErrInvalidPageSize
+	}
+
+	if page < 1 {
+		page = 1
+	}
+
+	var total int64
+	var err error
+
+	approximate := paginateOptions.Approximate && query.Err == nil && !query.hasFilters()
+
+	if approximate {
+		total, err = EstimatedDocumentCountCtx(ctx, database, collectionName)
+	} else {
+		total, err = CountDocumentsCtx(ctx, database, collectionName, query)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	pageQuery := query.Clone()
+	skip := (page - 1) * pageSize
+	PaginateQuery(pageQuery, &skip, &pageSize)
+
+	items, err := GetDocumentsTypedCtx[T](ctx, database, collectionName, pageQuery)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PaginatedResult[T]{
+		Items:       items,
+		Total:       total,
+		Page:        page,
+		PageSize:    pageSize,
+		TotalPages:  int((total + int64(pageSize) - 1) / int64(pageSize)),
+		Approximate: approximate,
+	}, nil
+}
+
+// Retrieves the decoded documents matching the query, along with the total count of matching documents.
+// The total ignores the skip and limit options, the documents respect them.
+func GetDocumentsWithCount[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) ([]T, int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentsWithCountCtx[T](ctx, database, collectionName, query)
+}
+
+// Retrieves the decoded documents matching the query and their total count within the provided context.
+func GetDocumentsWithCountCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) ([]T, int64, error) {
+	total, err := CountDocumentsCtx(ctx, database, collectionName, query)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items, err := GetDocumentsTypedCtx[T](ctx, database, collectionName, query)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return items, total, nil
+}
+
+// Retrieves the page of decoded documents following afterValue(see PaginateAfter()), leaving the QuerySet untouched.
+// Also returns the sort field's value of the last document, to be passed as afterValue for the next page,
+// nil once there are no more documents.
+func GetDocumentsAfter[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	sortField string,
+	afterValue interface{},
+	limit int,
+) ([]T, interface{}, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDocumentsAfterCtx[T](ctx, database, collectionName, query, sortField, afterValue, limit)
+}
+
+// Retrieves the page of decoded documents following afterValue within the provided context.
+func GetDocumentsAfterCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	sortField string,
+	afterValue interface{},
+	limit int,
+) ([]T, interface{}, error) {
+	pageQuery := query.Clone()
+	PaginateAfter(pageQuery, sortField, afterValue, limit)
+
+	items, err := GetDocumentsTypedCtx[T](ctx, database, collectionName, pageQuery)
+
+	if err != nil || len(items) == 0 {
+		return items, nil, err
+	}
+
+	raw, err := bson.Marshal(items[len(items)-1])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err := bson.Raw(raw).LookupErr(strings.Split(sortField, ".")...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var lastValue interface{}
+	err = value.Unmarshal(&lastValue)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return items, lastValue, nil
+}
+
+// Helper function for an UpdateOne() operation.
+// Utilizes the QuerySet abstraction.
+func UpdateDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return UpdateDocumentCtx(ctx, database, collectionName, query, update)
+}
+
+// Helper function for an UpdateOne() operation with per call options.
+func UpdateDocumentOpts(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+	opts OpOptions,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return UpdateDocumentCtx(ctx, opts.configure(database), collectionName, query, update)
+}
+
+// Helper function for an UpdateOne() operation within the provided context.
+func UpdateDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.UpdateResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+
+	if query.UpdateOptions != nil {
+		res, err := collection.UpdateOne(ctx, query.BuildCtx(ctx, database), update, query.UpdateOptions)
+
+		return res, wrapError("UpdateOne", collectionName, err)
+	}
+
+	res, err := collection.UpdateOne(ctx, query.BuildCtx(ctx, database), update)
+
+	return res, wrapError("UpdateOne", collectionName, err)
+}
+
+// Helper function for an UpdateMany() operation.
+// Utilizes the QuerySet abstraction.
+func UpdateDocuments(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return UpdateDocumentsCtx(ctx, database, collectionName, query, update)
+}
+
+// Helper function for an UpdateMany() operation with per call options.
+func UpdateDocumentsOpts(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+	opts OpOptions,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return UpdateDocumentsCtx(ctx, opts.configure(database), collectionName, query, update)
+}
+
+// Helper function for an UpdateMany() operation within the provided context.
+func UpdateDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.UpdateResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+
+	if query.UpdateOptions != nil {
+		res, err := collection.UpdateMany(ctx, query.BuildCtx(ctx, database), update, query.UpdateOptions)
+
+		return res, wrapError("UpdateMany", collectionName, err)
+	}
+
+	res, err := collection.UpdateMany(ctx, query.BuildCtx(ctx, database), update)
+
+	return res, wrapError("UpdateMany", collectionName, err)
+}
+
+// Increments the field of the first document matching the query by delta, a negative delta decrements it.
+func IncrementField(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	delta int64,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return IncrementFieldCtx(ctx, database, collectionName, query, field, delta)
+}
+
+// Increments the field of the first document matching the query within the provided context.
+func IncrementFieldCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	delta int64,
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentCtx(ctx, database, collectionName, query, bson.M{"$inc": bson.M{field: delta}})
+}
+
+// Sets the fields of the first document matching the query.
+func SetFields(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields bson.M,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SetFieldsCtx(ctx, database, collectionName, query, fields)
+}
+
+// Sets the fields of the first document matching the query within the provided context.
+func SetFieldsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields bson.M,
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentCtx(ctx, database, collectionName, query, bson.M{"$set": fields})
+}
+
+// Appends the values to the array field of the first document matching the query.
+func PushToArray(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	values ...interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PushToArrayCtx(ctx, database, collectionName, query, field, values...)
+}
+
+// Appends the values to the array field of the first matching document within the provided context.
+func PushToArrayCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	values ...interface{},
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentCtx(
+		ctx,
+		database,
+		collectionName,
+		query,
+		bson.M{"$push": bson.M{field: bson.M{"$each": arrayValues(values)}}},
+	)
+}
+
+// Appends the values missing from the array field of the first document matching the query.
+func AddToSet(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	values ...interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return AddToSetCtx(ctx, database, collectionName, query, field, values...)
+}
+
+// Appends the values missing from the array field of the first matching document within the provided context.
+func AddToSetCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	values ...interface{},
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentCtx(
+		ctx,
+		database,
+		collectionName,
+		query,
+		bson.M{"$addToSet": bson.M{field: bson.M{"$each": arrayValues(values)}}},
+	)
+}
+
+// Removes the elements matching the condition, a value or a query such as bson.M{"$gt": 5},
+// from the array field of the first document matching the query.
+func PullFromArray(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	condition interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PullFromArrayCtx(ctx, database, collectionName, query, field, condition)
+}
+
+// Removes the elements matching the condition from the array field within the provided context.
+func PullFromArrayCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	field string,
+	condition interface{},
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentCtx(
+		ctx,
+		database,
+		collectionName,
+		query,
+		bson.M{"$pull": bson.M{field: condition}},
+	)
+}
+
+// Removes the fields from all the documents matching the query.
+func UnsetFields(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields ...string,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return UnsetFieldsCtx(ctx, database, collectionName, query, fields...)
+}
+
+// Removes the fields from all the documents matching the query within the provided context.
+func UnsetFieldsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields ...string,
+) (*mongo.UpdateResult, error) {
+	if len(fields) == 0 {
+		return &mongo.UpdateResult{}, nil
+	}
+
+	unset := bson.M{}
+
+	for _, field := range fields {
+		// $unset ignores the value.
+		unset[field] = ""
+	}
+
+	return UpdateDocumentsCtx(ctx, database, collectionName, query, bson.M{"$unset": unset})
+}
+
+// Renames the field of all the documents matching the query, e.g. for a migration.
+func RenameField(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	from, to string,
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return RenameFieldCtx(ctx, database, collectionName, query, from, to)
+}
+
+// Renames the field of all the documents matching the query within the provided context.
+func RenameFieldCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	from, to string,
+) (*mongo.UpdateResult, error) {
+	return UpdateDocumentsCtx(ctx, database, collectionName, query, bson.M{"$rename": bson.M{from: to}})
+}
+
+// Inserts the document unless one matching the query exists, in a single upsert with $setOnInsert.
+// Returns whether the document was inserted. Concurrent calls are only guaranteed to insert once
+// with a unique index on the queried fields, the losers of a race then report false.
+// A duplicate key error on another unique index is returned.
+func InsertIfAbsent(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	document interface{},
+) (bool, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return InsertIfAbsentCtx(ctx, database, collectionName, query, document)
+}
+
+// Inserts the document unless one matching the query exists within the provided context.
+func InsertIfAbsentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	document interface{},
+) (bool, error) {
+	upsertQuery := query.Clone().Upsert(true)
+	res, err := UpdateDocumentCtx(ctx, database, collectionName, upsertQuery, bson.M{"$setOnInsert": document})
+
+	// Only the race on the queried fields is reported as absent, not a clash on another unique index.
+	if IsDuplicateKeyError(err) {
+		exists, existsErr := DocumentExistsCtx(ctx, database, collectionName, query)
+
+		if existsErr != nil {
+			return false, existsErr
+		}
+
+		if exists {
+			return false, nil
+		}
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return res.UpsertedID != nil, nil
+}
+
+// Ensures no values are sent as an empty array rather than null.
+func arrayValues(values []interface{}) []interface{} {
+	if values == nil {
+		return []interface{}{}
+	}
+
+	return values
+}
+
+// Helper function for a ReplaceOne() operation.
+// Utilizes the QuerySet abstraction, honoring its upsert option.
+func ReplaceDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	replacement interface{},
+) (*mongo.UpdateResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return ReplaceDocumentCtx(ctx, database, collectionName, query, replacement)
+}
+
+// Helper function for a ReplaceOne() operation within the provided context.
+func ReplaceDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	replacement interface{},
+) (*mongo.UpdateResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res, err := collection.ReplaceOne(
+		ctx,
+		query.BuildCtx(ctx, database),
+		replacement,
+		query.ReplaceOptions(),
+	)
+
+	return res, wrapError("ReplaceOne", collectionName, err)
+}
+
+// Helper function for a FindOneAndUpdate() operation.
+// Return no error in the case of no document found.
+// Utilizes the QuerySet abstraction.
+func FindAndUpdateDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.SingleResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return FindAndUpdateDocumentCtx(ctx, database, collectionName, query, update)
+}
+
+// Helper function for a FindOneAndUpdate() operation within the provided context.
+func FindAndUpdateDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	update interface{},
+) (*mongo.SingleResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res := collection.FindOneAndUpdate(
+		ctx,
+		query.BuildCtx(ctx, database),
+		update,
+		query.FindOneAndUpdateOptions(),
+	)
+
+	res, err = checkSingleResult(res)
+
+	return res, wrapError("FindOneAndUpdate", collectionName, err)
+}
+
+// Helper function for a FindOneAndDelete() operation, returning the deleted document.
+// Return no error in the case of no document found.
+// Utilizes the QuerySet abstraction, honoring its sort.
+func FindAndDeleteDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.SingleResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return FindAndDeleteDocumentCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a FindOneAndDelete() operation within the provided context.
+func FindAndDeleteDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.SingleResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res := collection.FindOneAndDelete(
+		ctx,
+		query.BuildCtx(ctx, database),
+		query.FindOneAndDeleteOptions(),
+	)
+
+	res, err = checkSingleResult(res)
+
+	return res, wrapError("FindOneAndDelete", collectionName, err)
+}
+
+// Helper function for a DeleteOne() operation.
+// Utilizes the QuerySet abstraction.
+func DeleteDocument(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a DeleteOne() operation with per call options.
+func DeleteDocumentOpts(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	opts OpOptions,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return DeleteDocumentCtx(ctx, opts.configure(database), collectionName, query)
+}
+
+// Helper function for a DeleteOne() operation within the provided context.
+func DeleteDocumentCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.DeleteResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+
+	if query.DeleteOptions != nil {
+		res, err := collection.DeleteOne(ctx, query.BuildCtx(ctx, database), query.DeleteOptions)
+
+		return res, wrapError("DeleteOne", collectionName, err)
+	}
+
+	res, err := collection.DeleteOne(ctx, query.BuildCtx(ctx, database))
+
+	return res, wrapError("DeleteOne", collectionName, err)
+}
+
+// Helper function for deleting the document with the _id value.
+// A DeletedCount of 0, with no error, reports that no document matched.
+func DeleteDocumentByID(
+	database *mongo.Database,
+	collectionName string,
+	id primitive.ObjectID,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentByIDCtx(ctx, database, collectionName, id)
+}
+
+// Helper function for deleting the document with the _id value within the provided context.
+func DeleteDocumentByIDCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	id primitive.ObjectID,
+) (*mongo.DeleteResult, error) {
+	return DeleteDocumentCtx(ctx, database, collectionName, CreateQuery(bson.M{"_id": id}))
+}
+
+// Helper function for deleting the document with the hex encoded _id value.
+// Fails for malformed hex values.
+func DeleteDocumentByHexID(
+	database *mongo.Database,
+	collectionName string,
+	hexID string,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentByHexIDCtx(ctx, database, collectionName, hexID)
+}
+
+// Helper function for deleting the document with the hex encoded _id value within the provided context.
+func DeleteDocumentByHexIDCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	hexID string,
+) (*mongo.DeleteResult, error) {
+	id, err := primitive.ObjectIDFromHex(hexID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DeleteDocumentByIDCtx(ctx, database, collectionName, id)
+}
+
+// Helper function for a DeleteMany() operation.
+// Utilizes the QuerySet abstraction.
+func DeleteDocuments(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a DeleteMany() operation with per call options.
+func DeleteDocumentsOpts(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	opts OpOptions,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return DeleteDocumentsCtx(ctx, opts.configure(database), collectionName, query)
+}
+
+// Helper function for a DeleteMany() operation within the provided context.
+func DeleteDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (*mongo.DeleteResult, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+
+	if query.DeleteOptions != nil {
+		res, err := collection.DeleteMany(ctx, query.BuildCtx(ctx, database), query.DeleteOptions)
+
+		return res, wrapError("DeleteMany", collectionName, err)
+	}
+
+	res, err := collection.DeleteMany(ctx, query.BuildCtx(ctx, database))
+
+	return res, wrapError("DeleteMany", collectionName, err)
+}
+
+// Helper function for deleting the documents with the _id values in a single DeleteMany() operation.
+func DeleteDocumentsByIDs(
+	database *mongo.Database,
+	collectionName string,
+	ids []primitive.ObjectID,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentsByIDsCtx(ctx, database, collectionName, ids)
+}
+
+// Helper function for deleting the documents with the _id values within the provided context.
+func DeleteDocumentsByIDsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	ids []primitive.ObjectID,
+) (*mongo.DeleteResult, error) {
+	if len(ids) == 0 {
+		return &mongo.DeleteResult{}, nil
+	}
+
+	return DeleteDocumentsCtx(ctx, database, collectionName, CreateQuery(bson.M{"_id": bson.M{"$in": ids}}))
+}
+
+// Helper function for deleting the documents with the hex encoded _id values.
+// Fails, deleting nothing, on the first malformed hex value.
+func DeleteDocumentsByHexIDs(
+	database *mongo.Database,
+	collectionName string,
+	hexIDs []string,
+) (*mongo.DeleteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DeleteDocumentsByHexIDsCtx(ctx, database, collectionName, hexIDs)
+}
+
+// Helper function for deleting the documents with the hex encoded _id values within the provided context.
+func DeleteDocumentsByHexIDsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	hexIDs []string,
+) (*mongo.DeleteResult, error) {
+	ids, err := objectIDsFromHex(hexIDs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DeleteDocumentsByIDsCtx(ctx, database, collectionName, ids)
+}
+
+// Parses the hex encoded _id values, failing on the first malformed one.
+func objectIDsFromHex(hexIDs []string) ([]primitive.ObjectID, error) {
+	ids := make([]primitive.ObjectID, len(hexIDs))
+
+	for i_, hexID := range hexIDs {
+		id, err := primitive.ObjectIDFromHex(hexID)
+
+		if err != nil {
+			return nil, fmt.Errorf("mongodbutilities: invalid id %q: %w", hexID, err)
+		}
+
+		ids[i_] = id
+	}
+
+	return ids, nil
+}
+
+// Helper function for a CountDocuments() operation.
+// Utilizes the QuerySet abstraction.
+func CountDocuments(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return CountDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a CountDocuments() operation with per call options.
+func CountDocumentsOpts(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	opts OpOptions,
+) (int64, error) {
+	ctx, cancel := opts.Context()
+
+	defer cancel()
+
+	return CountDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Helper function for a CountDocuments() operation within the provided context.
+func CountDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (int64, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return 0, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res, err := collection.CountDocuments(ctx, query.BuildCtx(ctx, database), query.CountOptions())
+
+	return res, wrapError("CountDocuments", collectionName, err)
+}
+
+// Counts the documents matching the query, an alias of CountDocuments() for readability at call sites.
+func CountMatching(database *mongo.Database, collectionName string, query *QuerySet) (int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return CountMatchingCtx(ctx, database, collectionName, query)
+}
+
+// Counts the documents matching the query within the provided context.
+func CountMatchingCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (int64, error) {
+	return CountDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Counts the documents DeleteDocuments() would delete with the query, without deleting any.
+// Useful as a dry run guarding against a too broad filter.
+func PreviewDelete(database *mongo.Database, collectionName string, query *QuerySet) (int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PreviewDeleteCtx(ctx, database, collectionName, query)
+}
+
+// Counts the documents DeleteDocuments() would delete within the provided context.
+func PreviewDeleteCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (int64, error) {
+	return CountDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Counts the documents UpdateDocuments() would update with the query, without updating any.
+// Upserts are not accounted for, a preview of 0 may still insert a document.
+func PreviewUpdate(database *mongo.Database, collectionName string, query *QuerySet) (int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return PreviewUpdateCtx(ctx, database, collectionName, query)
+}
+
+// Counts the documents UpdateDocuments() would update within the provided context.
+func PreviewUpdateCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (int64, error) {
+	return CountDocumentsCtx(ctx, database, collectionName, query)
+}
+
+// Checks whether any document matches the query, stopping at the first match.
+// Utilizes the QuerySet abstraction.
+func DocumentExists(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (bool, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DocumentExistsCtx(ctx, database, collectionName, query)
+}
+
+// Checks whether any document matches the query within the provided context.
+func DocumentExistsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+) (bool, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return false, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	res, err := collection.CountDocuments(
+		ctx,
+		query.BuildCtx(ctx, database),
+		query.CountOptions().SetLimit(1),
+	)
+
+	return res > 0, wrapError("CountDocuments", collectionName, err)
+}
+
+// Helper function for an EstimatedDocumentCount() operation.
+// Counts every document of the collection from its metadata, no filter can be applied.
+func EstimatedDocumentCount(database *mongo.Database, collectionName string) (int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return EstimatedDocumentCountCtx(ctx, database, collectionName)
+}
+
+// Helper function for an EstimatedDocumentCount() operation within the provided context.
+func EstimatedDocumentCountCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+) (int64, error) {
+	collection := database.Collection(collectionName)
+	res, err := collection.EstimatedDocumentCount(ctx)
+
+	return res, wrapError("EstimatedDocumentCount", collectionName, err)
+}
+
+// Helper function for a Distinct() operation.
+// Utilizes the QuerySet abstraction.
+func DistinctValues(
+	database *mongo.Database,
+	collectionName string,
+	field string,
+	query *QuerySet,
+) ([]interface{}, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DistinctValuesCtx(ctx, database, collectionName, field, query)
+}
+
+// Helper function for a Distinct() operation within the provided context.
+func DistinctValuesCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	field string,
+	query *QuerySet,
+) ([]interface{}, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	collection := query.Collection(database, collectionName)
+	distinctOptions := options.Distinct()
+
+	if query.FindOptions != nil {
+		distinctOptions.Collation = query.FindOptions.Collation
+	}
+
+	res, err := collection.Distinct(ctx, field, query.BuildCtx(ctx, database), distinctOptions)
+
+	return res, wrapError("Distinct", collectionName, err)
+}
+
+// Helper function for a Distinct() operation, decoding the values found.
+func DistinctTyped[T any](
+	database *mongo.Database,
+	collectionName string,
+	field string,
+	query *QuerySet,
+) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return DistinctTypedCtx[T](ctx, database, collectionName, field, query)
+}
+
+// Helper function for a decoded Distinct() operation within the provided context.
+func DistinctTypedCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	field string,
+	query *QuerySet,
+) ([]T, error) {
+	values, err := DistinctValuesCtx(ctx, database, collectionName, field, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := bson.Marshal(bson.M{"values": values})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded struct {
+		Values []T `bson:"values"`
+	}
+	err = bson.Unmarshal(raw, &decoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if decoded.Values == nil {
+		return []T{}, nil
+	}
+
+	return decoded.Values, nil
+}
+
+// Helper function for an Aggregate() operation, e.g. options.Aggregate().SetAllowDiskUse(true)
+func AggregateDocuments(
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	aggregateOptions ...*options.AggregateOptions,
+) (*mongo.Cursor, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return AggregateDocumentsCtx(ctx, database, collectionName, pipeline, aggregateOptions...)
+}
+
+// Helper function for an Aggregate() operation within the provided context.
+func AggregateDocumentsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	aggregateOptions ...*options.AggregateOptions,
+) (*mongo.Cursor, error) {
+	collection := database.Collection(collectionName)
+	res, err := collection.Aggregate(ctx, pipeline, aggregateOptions...)
+
+	return res, wrapError("Aggregate", collectionName, err)
+}
+
+// Helper function for an Aggregate() operation, decoding all the results.
+// The pipeline is typically a mongo.Pipeline built by an AggregateSet, passed along with its AggregateOptions.
+func AggregateTyped[T any](
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	aggregateOptions ...*options.AggregateOptions,
+) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return AggregateTypedCtx[T](ctx, database, collectionName, pipeline, aggregateOptions...)
+}
+
+// Helper function for a decoded Aggregate() operation within the provided context.
+func AggregateTypedCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	aggregateOptions ...*options.AggregateOptions,
+) ([]T, error) {
+	cursor, err := AggregateDocumentsCtx(ctx, database, collectionName, pipeline, aggregateOptions...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeAllCtx[T](ctx, cursor)
+}
+
+// Helper function for a streamed Aggregate() operation, decoding and handing the results to fn one at a time.
+// Stops at the first error returned by fn, the cursor is closed in every case.
+// Large aggregations may need options.Aggregate().SetAllowDiskUse(true)
+func StreamAggregate[T any](
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	fn func(T) error,
+	aggregateOptions ...*options.AggregateOptions,
+) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return StreamAggregateCtx(ctx, database, collectionName, pipeline, fn, aggregateOptions...)
+}
+
+// Helper function for a streamed Aggregate() operation within the provided context.
+func StreamAggregateCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	fn func(T) error,
+	aggregateOptions ...*options.AggregateOptions,
+) error {
+	cursor, err := AggregateDocumentsCtx(ctx, database, collectionName, pipeline, aggregateOptions...)
+
+	if err != nil {
+		return err
+	}
+
+	return StreamCursorCtx(ctx, cursor, fn)
+}
+
+// Counts the documents matching the query per value of groupField.
+// Values are keyed by their string representation, documents lacking the field are keyed "<nil>".
+func GroupCount(
+	database *mongo.Database,
+	collectionName string,
+	groupField string,
+	query *QuerySet,
+) (map[string]int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GroupCountCtx(ctx, database, collectionName, groupField, query)
+}
+
+// Counts the documents matching the query per value of groupField within the provided context.
+func GroupCountCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	groupField string,
+	query *QuerySet,
+) (map[string]int64, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := CreateAggregate().
+		Match(query).
+		Group(bson.M{"_id": "$" + groupField, "count": bson.M{"$sum": 1}}).
+		BuildCtx(ctx, database)
+
+	groups, err := AggregateTypedCtx[struct {
+		ID    interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+	}](ctx, database, collectionName, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(groups))
+
+	for _, group := range groups {
+		counts[fmt.Sprint(group.ID)] = group.Count
+	}
+
+	return counts, nil
+}
+
+// Sums sumField over the documents matching the query per value of groupField.
+// Values are keyed like GroupCount() keys them.
+func GroupSum(
+	database *mongo.Database,
+	collectionName string,
+	groupField, sumField string,
+	query *QuerySet,
+) (map[string]float64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GroupSumCtx(ctx, database, collectionName, groupField, sumField, query)
+}
+
+// Sums sumField over the documents matching the query per value of groupField within the provided context.
+func GroupSumCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	groupField, sumField string,
+	query *QuerySet,
+) (map[string]float64, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := CreateAggregate().
+		Match(query).
+		Group(bson.M{"_id": "$" + groupField, "sum": bson.M{"$sum": "$" + sumField}}).
+		BuildCtx(ctx, database)
+
+	groups, err := AggregateTypedCtx[struct {
+		ID  interface{} `bson:"_id"`
+		Sum float64     `bson:"sum"`
+	}](ctx, database, collectionName, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]float64, len(groups))
+
+	for _, group := range groups {
+		sums[fmt.Sprint(group.ID)] = group.Sum
 	}
+
+	return sums, nil
 }
 
-// Blueprint for a document that is to be stored in a collection.
-type BaseModel interface {
-	// Should be able to return the documents _id value
-	GetID() primitive.ObjectID
-	// Should be able to set the document's _id value.
-	SetID(primitive.ObjectID)
+// Counts the documents matching the query per value of every field, in a single $facet aggregation.
+// Returns the value counts keyed by field name, values keyed like GroupCount() keys them.
+func Facet(
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields ...string,
+) (map[string]map[string]int64, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return FacetCtx(ctx, database, collectionName, query, fields...)
 }
 
-// Inserts/ Updates the model(document) in a collection.
-// Sets the _id value if its an insertion operation.
-func SaveModel(instance BaseModel, database *mongo.Database, collectionName string) error {
-	if instance.GetID() == primitive.NilObjectID {
-		res, err := InsertDocument(database, collectionName, instance)
+// Counts the documents matching the query per value of every field within the provided context.
+func FacetCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	fields ...string,
+) (map[string]map[string]int64, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	facets := make(map[string]map[string]int64, len(fields))
+
+	if len(fields) == 0 {
+		return facets, nil
+	}
+
+	// Facet names cannot contain dots, the fields are named by position instead.
+	facetStages := bson.M{}
+
+	for i_, field := range fields {
+		facetStages[fmt.Sprint("facet", i_)] = bson.A{
+			bson.M{"$group": bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}},
+		}
+	}
+
+	pipeline := CreateAggregate().
+		Match(query).
+		AddStage("$facet", facetStages).
+		BuildCtx(ctx, database)
+
+	results, err := AggregateTypedCtx[map[string][]struct {
+		ID    interface{} `bson:"_id"`
+		Count int64       `bson:"count"`
+	}](ctx, database, collectionName, pipeline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i_, field := range fields {
+		counts := make(map[string]int64)
+
+		if len(results) > 0 {
+			for _, group := range results[0][fmt.Sprint("facet", i_)] {
+				counts[fmt.Sprint(group.ID)] = group.Count
+			}
+		}
+
+		facets[field] = counts
+	}
+
+	return facets, nil
+}
+
+// Returned when a sample of fewer than 1 document is requested.
+var ErrInvalidSampleSize = errors.New("mongodbutilities: sample size must be greater than 0")
+
+// Helper function for retrieving up to size random documents matching the query, decoded.
+// Returns fewer documents when fewer match.
+func SampleDocuments[T any](
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	size int,
+) ([]T, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return SampleDocumentsCtx[T](ctx, database, collectionName, query, size)
+}
+
+// Helper function for retrieving random documents matching the query within the provided context.
+func SampleDocumentsCtx[T any](
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	query *QuerySet,
+	size int,
+) ([]T, error) {
+	query, err := query.resolveJoinsCtx(ctx, database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if size < 1 {
+		return nil, ErrInvalidSampleSize
+	}
+
+	pipeline := CreateAggregate().
+		Match(query).
+		AddStage("$sample", bson.M{"size": size}).
+		BuildCtx(ctx, database)
+
+	return AggregateTypedCtx[T](ctx, database, collectionName, pipeline)
+}
+
+// Watches the collection's change stream, handing every change event to fn until fn returns an error.
+// Unlike the other helpers it is not bounded by DefaultTimeout, see WatchCollectionCtx() for cancellation.
+func WatchCollection(
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	resumeToken bson.Raw,
+	fn func(event bson.M) error,
+) error {
+	return WatchCollectionCtx(context.Background(), database, collectionName, pipeline, resumeToken, fn)
+}
+
+// Watches the collection's change stream until the context is done or fn returns an error.
+// The pipeline(nil for every change) filters the events. Every event's _id is its resume token,
+// passing the last one handled as resumeToken resumes after it(nil starts from the current time).
+// Change streams require a replica set or a sharded cluster.
+func WatchCollectionCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	pipeline interface{},
+	resumeToken bson.Raw,
+	fn func(event bson.M) error,
+) error {
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+
+	changeStreamOptions := options.ChangeStream()
+
+	if resumeToken != nil {
+		changeStreamOptions.SetResumeAfter(resumeToken)
+	}
+
+	collection := database.Collection(collectionName)
+	stream, err := collection.Watch(ctx, pipeline, changeStreamOptions)
+
+	if err != nil {
+		return wrapError("Watch", collectionName, err)
+	}
+
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event bson.M
+		err = stream.Decode(&event)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(event)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return wrapError("Watch", collectionName, stream.Err())
+}
+
+// Emulates a builder for a batch of write operations sent in a single BulkWrite()
+type BulkBuilder struct {
+	// Includes all the write operations, in order. Filters are built when the batch is executed.
+	operations []func(ctx context.Context, database *mongo.Database) (mongo.WriteModel, error)
+	// Additional options for the BulkWrite() collection operation.
+	BulkWriteOptions *options.BulkWriteOptions
+}
+
+// Initializes an empty BulkBuilder instance
+func CreateBulk() *BulkBuilder {
+	var bulk BulkBuilder
+	bulk.BulkWriteOptions = options.BulkWrite()
+
+	return &bulk
+}
+
+// Adds an InsertOne operation to the batch
+func (instance *BulkBuilder) InsertOne(document interface{}) *BulkBuilder {
+	instance.operations = append(
+		instance.operations,
+		func(ctx context.Context, database *mongo.Database) (mongo.WriteModel, error) {
+			return mongo.NewInsertOneModel().SetDocument(document), nil
+		},
+	)
+
+	return instance
+}
+
+// Adds an UpdateOne operation to the batch, honoring the QuerySet's update options.
+func (instance *BulkBuilder) UpdateOne(query *QuerySet, update interface{}) *BulkBuilder {
+	instance.operations = append(
+		instance.operations,
+		func(ctx context.Context, database *mongo.Database) (mongo.WriteModel, error) {
+			query, err := query.resolveJoinsCtx(ctx, database)
+
+			if err != nil {
+				return nil, err
+			}
+
+			model := mongo.NewUpdateOneModel().
+				SetFilter(query.BuildCtx(ctx, database)).
+				SetUpdate(update)
+
+			if query.UpdateOptions != nil {
+				model.Upsert = query.UpdateOptions.Upsert
+				model.Collation = query.UpdateOptions.Collation
+				model.ArrayFilters = query.UpdateOptions.ArrayFilters
+				model.Hint = query.UpdateOptions.Hint
+			}
+
+			return model, nil
+		},
+	)
+
+	return instance
+}
+
+// Adds a DeleteOne operation to the batch, honoring the QuerySet's delete options.
+func (instance *BulkBuilder) DeleteOne(query *QuerySet) *BulkBuilder {
+	instance.operations = append(
+		instance.operations,
+		func(ctx context.Context, database *mongo.Database) (mongo.WriteModel, error) {
+			query, err := query.resolveJoinsCtx(ctx, database)
+
+			if err != nil {
+				return nil, err
+			}
+
+			model := mongo.NewDeleteOneModel().SetFilter(query.BuildCtx(ctx, database))
+
+			if query.DeleteOptions != nil {
+				model.Collation = query.DeleteOptions.Collation
+				model.Hint = query.DeleteOptions.Hint
+			}
+
+			return model, nil
+		},
+	)
+
+	return instance
+}
+
+// Adds a ReplaceOne operation to the batch, honoring the QuerySet's update options.
+func (instance *BulkBuilder) ReplaceOne(query *QuerySet, replacement interface{}) *BulkBuilder {
+	instance.operations = append(
+		instance.operations,
+		func(ctx context.Context, database *mongo.Database) (mongo.WriteModel, error) {
+			query, err := query.resolveJoinsCtx(ctx, database)
+
+			if err != nil {
+				return nil, err
+			}
+
+			model := mongo.NewReplaceOneModel().
+				SetFilter(query.BuildCtx(ctx, database)).
+				SetReplacement(replacement)
+
+			if query.UpdateOptions != nil {
+				model.Upsert = query.UpdateOptions.Upsert
+				model.Collation = query.UpdateOptions.Collation
+				model.Hint = query.UpdateOptions.Hint
+			}
+
+			return model, nil
+		},
+	)
+
+	return instance
+}
+
+// Sets whether the batch stops at the first failed operation(ordered) or attempts all of them.
+func (instance *BulkBuilder) Ordered(ordered bool) *BulkBuilder {
+	if instance.BulkWriteOptions == nil {
+		instance.BulkWriteOptions = options.BulkWrite()
+	}
+
+	instance.BulkWriteOptions = instance.BulkWriteOptions.SetOrdered(ordered)
+
+	return instance
+}
+
+// Sends the accumulated operations to the collection in a single BulkWrite() operation.
+func (instance *BulkBuilder) Execute(
+	database *mongo.Database,
+	collectionName string,
+) (*mongo.BulkWriteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return instance.ExecuteCtx(ctx, database, collectionName)
+}
+
+// Sends the accumulated operations to the collection within the provided context.
+// Nothing is sent when the QuerySet of an operation recorded an error or one of its joins fails.
+func (instance *BulkBuilder) ExecuteCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+) (*mongo.BulkWriteResult, error) {
+	models := make([]mongo.WriteModel, len(instance.operations))
+
+	for i_, operation := range instance.operations {
+		model, err := operation(ctx, database)
+
+		if err != nil {
+			return nil, err
+		}
+
+		models[i_] = model
+	}
+
+	collection := database.Collection(collectionName)
+
+	if instance.BulkWriteOptions != nil {
+		res, err := collection.BulkWrite(ctx, models, instance.BulkWriteOptions)
+
+		return res, wrapError("BulkWrite", collectionName, err)
+	}
+
+	res, err := collection.BulkWrite(ctx, models)
+
+	return res, wrapError("BulkWrite", collectionName, err)
+}
+
+// Returned when a document to be upserted lacks its key field.
+var ErrMissingKey = errors.New("mongodbutilities: document is missing its key field")
+
+// Inserts or updates every document, matching the stored ones by their keyField value, in a single BulkWrite().
+// Running the same batch twice updates the documents inserted by the first run instead of duplicating them.
+func UpsertMany(
+	database *mongo.Database,
+	collectionName string,
+	keyField string,
+	documents []bson.M,
+) (*mongo.BulkWriteResult, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return UpsertManyCtx(ctx, database, collectionName, keyField, documents)
+}
+
+// Inserts or updates every document, matched by their keyField value, within the provided context.
+func UpsertManyCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	keyField string,
+	documents []bson.M,
+) (*mongo.BulkWriteResult, error) {
+	if len(documents) == 0 {
+		return &mongo.BulkWriteResult{}, nil
+	}
+
+	bulk := CreateBulk()
+
+	for _, document := range documents {
+		key, hasKey := document[keyField]
+
+		if !hasKey {
+			return nil, ErrMissingKey
+		}
+
+		bulk.UpdateOne(
+			CreateQuery(bson.M{keyField: key}).Upsert(true),
+			bson.M{"$set": document},
+		)
+	}
+
+	return bulk.ExecuteCtx(ctx, database, collectionName)
+}
+
+// Parameter for index creation
+type IndexField struct {
+	Field     string
+	Ascending bool
+}
+
+// Helper function for creating a non-unique index on one or more fields.
+// Indexes created through this function used to be unique, use CreateUniqueIndexes() for those.
+func CreateIndexes(
+	database *mongo.Database,
+	collectionName string,
+	fields ...IndexField,
+) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return CreateIndexesCtx(ctx, database, collectionName, fields...)
+}
+
+// Helper function for creating a non-unique index within the provided context.
+func CreateIndexesCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	fields ...IndexField,
+) error {
+	_, err := CreateIndexWithOptionsCtx(ctx, database, collectionName, options.Index(), fields...)
+
+	return err
+}
+
+// Helper function for creating a unique index on one or more fields.
+func CreateUniqueIndexes(
+	database *mongo.Database,
+	collectionName string,
+	fields ...IndexField,
+) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return CreateUniqueIndexesCtx(ctx, database, collectionName, fields...)
+}
+
+// Helper function for creating a unique index within the provided context.
+func CreateUniqueIndexesCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	fields ...IndexField,
+) error {
+	_, err := CreateIndexWithOptionsCtx(
+		ctx,
+		database,
+		collectionName,
+		options.Index().SetUnique(true),
+		fields...,
+	)
 
-		if err == nil {
-			instance.SetID(res.InsertedID.(primitive.ObjectID))
-		}
+	return err
+}
 
-		return err
+// Helper function for creating an index with caller controlled options.
+// Returns the name of the created index.
+func CreateIndexWithOptions(
+	database *mongo.Database,
+	collectionName string,
+	indexOptions *options.IndexOptions,
+	fields ...IndexField,
+) (string, error) {
+	ctx, cancel := NewContext()
 
-	} else {
-		var query QuerySet
-		query.Filter(bson.M{"_id": instance.GetID()})
-		_, err := UpdateDocument(
-			database,
-			collectionName,
-			&query,
-			bson.M{"$set": instance},
-		)
+	defer cancel()
 
-		return err
-	}
+	return CreateIndexWithOptionsCtx(ctx, database, collectionName, indexOptions, fields...)
 }
 
-// Deletes the model(document) from a collection.
-func DeleteModel(instance BaseModel, database *mongo.Database, collectionName string) error {
-	if instance.GetID() == primitive.NilObjectID {
-		return nil
-
-	} else {
-		var query QuerySet
-		query.Filter(bson.M{"_id": instance.GetID()})
-		_, err := DeleteDocument(
-			database,
-			collectionName,
-			&query,
-		)
+// Helper function for creating an index with caller controlled options within the provided context.
+func CreateIndexWithOptionsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	indexOptions *options.IndexOptions,
+	fields ...IndexField,
+) (string, error) {
+	var models bson.D = bson.D{}
 
-		return err
+	for _, field := range fields {
+		if field.Ascending {
+			models = append(models, bson.E{Key: field.Field, Value: 1})
+		} else {
+			models = append(models, bson.E{Key: field.Field, Value: -1})
+		}
 	}
+
+	return CreateCompoundIndexCtx(ctx, database, collectionName, models, indexOptions)
 }
 
-// Initializes a Mongodb database connection from a URI and a database name
-func GetDatabase(url, name string) (*mongo.Database, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+// Helper function for creating an index over the ordered keys, e.g. bson.D{{"a", 1}, {"b", -1}}.
+// Returns the name of the created index.
+func CreateCompoundIndex(
+	database *mongo.Database,
+	collectionName string,
+	keys bson.D,
+	indexOptions *options.IndexOptions,
+) (string, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(url)
-	client, err := mongo.Connect(ctx, clientOptions)
+	return CreateCompoundIndexCtx(ctx, database, collectionName, keys, indexOptions)
+}
 
-	if err != nil {
-		return nil, err
+// Helper function for creating an index over the ordered keys within the provided context.
+func CreateCompoundIndexCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	keys bson.D,
+	indexOptions *options.IndexOptions,
+) (string, error) {
+	collection := database.Collection(collectionName)
 
+	indexModel := mongo.IndexModel{
+		Keys:    keys,
+		Options: indexOptions,
 	}
 
-	return client.Database(name), nil
+	name, err := collection.Indexes().CreateOne(ctx, indexModel)
+
+	return name, wrapError("CreateIndex", collectionName, err)
 }
 
-// Helper function for an InsertOne operation.
-func InsertDocument(
+// Returned when a TTL index is requested with a negative expiry, one between 0 and 1 second
+// or one longer than the math.MaxInt32 seconds the server accepts.
+var ErrInvalidExpiry = errors.New("mongodbutilities: index expiry must be 0 or from 1 to 2147483647 seconds")
+
+// Helper function for creating a TTL index, expiring documents once the field is older than expireAfter.
+// The field must hold BSON dates, documents holding any other type never expire.
+// Returns the name of the created index.
+func CreateTTLIndex(
 	database *mongo.Database,
 	collectionName string,
-	document interface{},
-) (*mongo.InsertOneResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	field string,
+	expireAfter time.Duration,
+) (string, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
-	res, err := collection.InsertOne(ctx, document)
+	return CreateTTLIndexCtx(ctx, database, collectionName, field, expireAfter)
+}
 
-	return res, err
+// Helper function for creating a TTL index within the provided context.
+func CreateTTLIndexCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	field string,
+	expireAfter time.Duration,
+) (string, error) {
+	// The expiry is set in whole seconds, a sub-second one would expire the documents right away.
+	if expireAfter < 0 || (expireAfter > 0 && expireAfter < time.Second) || expireAfter.Seconds() > math.MaxInt32 {
+		return "", ErrInvalidExpiry
+	}
+
+	return CreateCompoundIndexCtx(
+		ctx,
+		database,
+		collectionName,
+		bson.D{{Key: field, Value: 1}},
+		options.Index().SetExpireAfterSeconds(int32(expireAfter.Seconds())),
+	)
 }
 
-// Helper function for an InsertMany operation.
-func InsertDocuments(
+// Helper function for creating an index covering only the documents matching filter, e.g. {deleted: false}.
+// A unique partial index enforces uniqueness among the matching documents only.
+// Returns the name of the created index.
+func CreatePartialIndex(
 	database *mongo.Database,
 	collectionName string,
-	document []interface{},
-) (*mongo.InsertManyResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	keys bson.D,
+	filter bson.M,
+	unique bool,
+) (string, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
-	res, err := collection.InsertMany(ctx, document)
+	return CreatePartialIndexCtx(ctx, database, collectionName, keys, filter, unique)
+}
 
-	return res, err
+// Helper function for creating a partial index within the provided context.
+func CreatePartialIndexCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	keys bson.D,
+	filter bson.M,
+	unique bool,
+) (string, error) {
+	return CreateCompoundIndexCtx(
+		ctx,
+		database,
+		collectionName,
+		keys,
+		options.Index().SetPartialFilterExpression(filter).SetUnique(unique),
+	)
 }
 
-// Helper function for a FindOne operation.
-// Return no error in the case of no document found.
-// Utilizes the QuerySet abstraction.
-func GetDocument(
+// Helper function for creating a text index over the fields, enabling QuerySet.Search().
+// A collection can only have one text index. Returns the name of the created index.
+func CreateTextIndex(
 	database *mongo.Database,
 	collectionName string,
-	query *QuerySet,
-) (*mongo.SingleResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	fields ...string,
+) (string, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
-	res := collection.FindOne(ctx, query.Build(database))
+	return CreateTextIndexCtx(ctx, database, collectionName, fields...)
+}
 
-	if res.Err() != nil {
-		if res.Err() == mongo.ErrNoDocuments {
-			return nil, nil
-		}
+// Helper function for creating a text index within the provided context.
+func CreateTextIndexCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	fields ...string,
+) (string, error) {
+	keys := make(bson.D, len(fields))
 
-		return nil, res.Err()
+	for i_, field := range fields {
+		keys[i_] = bson.E{Key: field, Value: "text"}
 	}
 
-	return res, nil
+	return CreateCompoundIndexCtx(ctx, database, collectionName, keys, options.Index())
 }
 
-// Helper function for a Find() operation.
-// Utilizes the QuerySet abstraction.
-func GetDocuments(
+// Helper function for creating a 2dsphere index over a GeoJSON field, enabling QuerySet.Near().
+// The index must exist before querying, $near fails without it. Returns the name of the created index.
+func CreateGeoIndex(database *mongo.Database, collectionName string, field string) (string, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return CreateGeoIndexCtx(ctx, database, collectionName, field)
+}
+
+// Helper function for creating a 2dsphere index within the provided context.
+func CreateGeoIndexCtx(
+	ctx context.Context,
 	database *mongo.Database,
 	collectionName string,
-	query *QuerySet,
-) (*mongo.Cursor, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	field string,
+) (string, error) {
+	keys := bson.D{bson.E{Key: field, Value: "2dsphere"}}
 
-	defer cancel()
+	return CreateCompoundIndexCtx(ctx, database, collectionName, keys, options.Index())
+}
 
-	collection := database.Collection(collectionName)
+// Helper function for creating a wildcard index over every field under path, e.g. user defined attributes.
+// An empty path indexes every field of the documents. Returns the name of the created index.
+func CreateWildcardIndex(database *mongo.Database, collectionName string, path string) (string, error) {
+	ctx, cancel := NewContext()
 
-	if query.FindOptions != nil {
-		return collection.Find(ctx, query.Build(database), query.FindOptions)
+	defer cancel()
 
-	} else {
-		return collection.Find(ctx, query.Build(database))
-	}
+	return CreateWildcardIndexCtx(ctx, database, collectionName, path)
 }
 
-// Helper function for an UpdateOne() operation.
-// Utilizes the QuerySet abstraction.
-func UpdateDocument(
+// Helper function for creating a wildcard index within the provided context.
+func CreateWildcardIndexCtx(
+	ctx context.Context,
 	database *mongo.Database,
 	collectionName string,
-	query *QuerySet,
-	update interface{},
-) (*mongo.UpdateResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	path string,
+) (string, error) {
+	field := "$**"
 
-	defer cancel()
+	if path != "" {
+		field = path + ".$**"
+	}
 
-	collection := database.Collection(collectionName)
+	keys := bson.D{bson.E{Key: field, Value: 1}}
 
-	if query.UpdateOptions != nil {
-		res, err := collection.UpdateOne(ctx, query.Build(database), update, query.UpdateOptions)
+	return CreateCompoundIndexCtx(ctx, database, collectionName, keys, options.Index())
+}
 
-		return res, err
-	}
+// Helper function for listing the full specifications(name, key, options) of a collection's indexes.
+func ListIndexes(database *mongo.Database, collectionName string) ([]bson.M, error) {
+	ctx, cancel := NewContext()
 
-	res, err := collection.UpdateOne(ctx, query.Build(database), update)
+	defer cancel()
 
-	return res, err
+	return ListIndexesCtx(ctx, database, collectionName)
 }
 
-// Helper function for an UpdateMany() operation.
-// Utilizes the QuerySet abstraction.
-func UpdateDocuments(
+// Helper function for listing a collection's indexes within the provided context.
+func ListIndexesCtx(
+	ctx context.Context,
 	database *mongo.Database,
 	collectionName string,
-	query *QuerySet,
-	update interface{},
-) (*mongo.UpdateResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+) ([]bson.M, error) {
+	collection := database.Collection(collectionName)
+	cursor, err := collection.Indexes().List(ctx)
+
+	if err != nil {
+		return nil, wrapError("ListIndexes", collectionName, err)
+	}
+
+	return DecodeAllCtx[bson.M](ctx, cursor)
+}
+
+// Checks whether the collection has an index with the name, false for a missing collection.
+func IndexExists(database *mongo.Database, collectionName, name string) (bool, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
+	return IndexExistsCtx(ctx, database, collectionName, name)
+}
 
-	if query.UpdateOptions != nil {
-		res, err := collection.UpdateMany(ctx, query.Build(database), update, query.UpdateOptions)
+// Checks whether the collection has an index with the name within the provided context.
+func IndexExistsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName, name string,
+) (bool, error) {
+	indexes, err := ListIndexesCtx(ctx, database, collectionName)
+
+	var commandError mongo.CommandError
+	if errors.As(err, &commandError) && commandError.Name == "NamespaceNotFound" {
+		return false, nil
+	}
 
-		return res, err
+	if err != nil {
+		return false, err
 	}
 
-	res, err := collection.UpdateMany(ctx, query.Build(database), update)
+	for _, index := range indexes {
+		if index["name"] == name {
+			return true, nil
+		}
+	}
 
-	return res, err
+	return false, nil
 }
 
-// Helper function for a DeleteOne() operation.
-// Utilizes the QuerySet abstraction.
-func DeleteDocument(
+// Helper function for creating an index over the keys unless an index with its name exists, e.g. on every deploy.
+// The name is taken from the options, or generated like the server does, e.g. "a_1_b_-1".
+// Returns whether the index was created.
+func EnsureIndex(
 	database *mongo.Database,
 	collectionName string,
-	query *QuerySet,
-) (*mongo.DeleteResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	keys bson.D,
+	indexOptions *options.IndexOptions,
+) (bool, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
+	return EnsureIndexCtx(ctx, database, collectionName, keys, indexOptions)
+}
 
-	if query.DeleteOptions != nil {
-		res, err := collection.DeleteOne(ctx, query.Build(database), query.DeleteOptions)
+// Helper function for creating an index unless it exists within the provided context.
+func EnsureIndexCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+	keys bson.D,
+	indexOptions *options.IndexOptions,
+) (bool, error) {
+	name := indexName(keys)
 
-		return res, err
+	if indexOptions != nil && indexOptions.Name != nil {
+		name = *indexOptions.Name
 	}
 
-	res, err := collection.DeleteOne(ctx, query.Build(database))
+	exists, err := IndexExistsCtx(ctx, database, collectionName, name)
 
-	return res, err
-}
+	if err != nil || exists {
+		return false, err
+	}
 
-// Helper function for a DeleteMany() operation.
-// Utilizes the QuerySet abstraction.
-func DeleteDocuments(
-	database *mongo.Database,
-	collectionName string,
-	query *QuerySet,
-) (*mongo.DeleteResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	_, err = CreateCompoundIndexCtx(ctx, database, collectionName, keys, indexOptions)
 
-	defer cancel()
+	if err != nil {
+		return false, err
+	}
 
-	collection := database.Collection(collectionName)
+	return true, nil
+}
 
-	if query.DeleteOptions != nil {
-		res, err := collection.DeleteMany(ctx, query.Build(database), query.DeleteOptions)
+// Generates the default name of an index over the keys.
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, len(keys)*2)
 
-		return res, err
+	for _, key := range keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
 	}
 
-	res, err := collection.DeleteMany(ctx, query.Build(database))
+	return strings.Join(parts, "_")
+}
+
+// Helper function for dropping a collection's index by name.
+func DropIndex(database *mongo.Database, collectionName, name string) error {
+	ctx, cancel := NewContext()
+
+	defer cancel()
 
-	return res, err
+	return DropIndexCtx(ctx, database, collectionName, name)
 }
 
-// Helper function for a CountDocuments() operation.
-// Utilizes the QuerySet abstraction.
-func CountDocuments(
+// Helper function for dropping a collection's index within the provided context.
+func DropIndexCtx(
+	ctx context.Context,
 	database *mongo.Database,
-	collectionName string,
-	query *QuerySet,
-) (int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	collectionName, name string,
+) error {
+	collection := database.Collection(collectionName)
+	_, err := collection.Indexes().DropOne(ctx, name)
+
+	return wrapError("DropIndex", collectionName, err)
+}
+
+// Helper function for dropping all of a collection's indexes, except the _id index.
+func DropAllIndexes(database *mongo.Database, collectionName string) error {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
+	return DropAllIndexesCtx(ctx, database, collectionName)
+}
+
+// Helper function for dropping all of a collection's indexes within the provided context.
+func DropAllIndexesCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+) error {
 	collection := database.Collection(collectionName)
-	res, err := collection.CountDocuments(ctx, query.Build(database))
+	_, err := collection.Indexes().DropAll(ctx)
 
-	return res, err
+	return wrapError("DropIndexes", collectionName, err)
 }
 
-// Helper function for an Aggregate() operation.
-func AggregateDocuments(
+// Returns the raw named collection of the database, for operations the helpers do not cover.
+func GetCollection(database *mongo.Database, collectionName string) *mongo.Collection {
+	return database.Collection(collectionName)
+}
+
+// Returns the raw named collection of the database acknowledging writes with the write concern,
+// e.g. writeconcern.W1() for a bulk import.
+func GetCollectionWithWriteConcern(
 	database *mongo.Database,
 	collectionName string,
-	pipeline interface{},
-) (*mongo.Cursor, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	writeConcern *writeconcern.WriteConcern,
+) *mongo.Collection {
+	return database.Collection(collectionName, options.Collection().SetWriteConcern(writeConcern))
+}
+
+// Helper function for listing a database collections.
+func ListCollections(database *mongo.Database) ([]string, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
-	res, err := collection.Aggregate(ctx, pipeline)
+	return ListCollectionsCtx(ctx, database)
+}
 
-	return res, err
+// Helper function for listing a database collections within the provided context.
+func ListCollectionsCtx(ctx context.Context, database *mongo.Database) ([]string, error) {
+	return ListCollectionsFilteredCtx(ctx, database, bson.M{})
 }
 
-// Parameter for index creation
-type IndexField struct {
-	Field     string
-	Ascending bool
+// Helper function for listing the database collections matching a filter,
+// e.g. bson.M{"name": bson.M{"$regex": "^log_"}} or bson.M{"type": "view"}
+func ListCollectionsFiltered(database *mongo.Database, filter interface{}) ([]string, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return ListCollectionsFilteredCtx(ctx, database, filter)
 }
 
-// Helper function for creating an index fo a single field
-func CreateIndexes(
+// Helper function for listing the database collections matching a filter within the provided context.
+func ListCollectionsFilteredCtx(
+	ctx context.Context,
 	database *mongo.Database,
-	collectionName string,
-	fields ...IndexField,
-) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+	filter interface{},
+) ([]string, error) {
+	return database.ListCollectionNames(ctx, filter)
+}
+
+// Checks whether the database has a collection(or view) with the provided name.
+func CollectionExists(database *mongo.Database, name string) (bool, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	collection := database.Collection(collectionName)
+	return CollectionExistsCtx(ctx, database, name)
+}
 
-	var models bson.M = bson.M{}
+// Checks whether the database has a collection with the provided name within the provided context.
+func CollectionExistsCtx(ctx context.Context, database *mongo.Database, name string) (bool, error) {
+	names, err := ListCollectionsFilteredCtx(ctx, database, bson.M{"name": name})
 
-	for _, field := range fields {
-		if field.Ascending {
-			models[field.Field] = 1
-		} else {
-			models[field.Field] = -1
-		}
+	if err != nil {
+		return false, err
 	}
 
-	indexModel := mongo.IndexModel{
-		Keys:    models,
-		Options: options.Index().SetUnique(true),
+	return len(names) > 0, nil
+}
+
+// Helper function for retrieving a collection's statistics(count, size, storageSize, totalIndexSize...)
+func GetCollectionStats(database *mongo.Database, collectionName string) (bson.M, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetCollectionStatsCtx(ctx, database, collectionName)
+}
+
+// Helper function for retrieving a collection's statistics within the provided context.
+func GetCollectionStatsCtx(
+	ctx context.Context,
+	database *mongo.Database,
+	collectionName string,
+) (bson.M, error) {
+	var stats bson.M
+	err := database.RunCommand(ctx, bson.D{{Key: "collStats", Value: collectionName}}).Decode(&stats)
+
+	if err != nil {
+		return nil, wrapError("collStats", collectionName, err)
 	}
 
-	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return stats, nil
+}
 
-	return err
+// Helper function for retrieving a database's statistics(collections, objects, dataSize, indexSize...)
+func GetDatabaseStats(database *mongo.Database) (bson.M, error) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	return GetDatabaseStatsCtx(ctx, database)
 }
 
-// Helper function for listing a database collections.
-func ListCollections(database *mongo.Database) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+// Helper function for retrieving a database's statistics within the provided context.
+func GetDatabaseStatsCtx(ctx context.Context, database *mongo.Database) (bson.M, error) {
+	var stats bson.M
+	err := database.RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&stats)
+
+	if err != nil {
+		return nil, wrapError("dbStats", database.Name(), err)
+	}
+
+	return stats, nil
+}
+
+// Helper function for running a database command the helpers do not cover, e.g. bson.D{{"serverStatus", 1}}
+// Commands taking several keys need a bson.D, the command name has to come first.
+func RunCommand(database *mongo.Database, command interface{}) (bson.M, error) {
+	ctx, cancel := NewContext()
 
 	defer cancel()
 
-	return database.ListCollectionNames(ctx, bson.M{})
+	return RunCommandCtx(ctx, database, command)
+}
+
+// Helper function for running a database command within the provided context.
+func RunCommandCtx(ctx context.Context, database *mongo.Database, command interface{}) (bson.M, error) {
+	var res bson.M
+	err := database.RunCommand(ctx, command).Decode(&res)
+
+	if err != nil {
+		return nil, wrapError("RunCommand", database.Name(), err)
+	}
+
+	return res, nil
 }
@@ -1 +1,6063 @@
 package mongodbutilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Returns a fresh database on the server at MONGODB_TEST_URI, dropped once the test ends.
+// Skips the test when MONGODB_TEST_URI is unset.
+func testDatabase(t testing.TB) *mongo.Database {
+	t.Helper()
+
+	url := os.Getenv("MONGODB_TEST_URI")
+
+	if url == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	database, err := GetDatabase(url, fmt.Sprintf("mongodbutilities_test_%d", time.Now().UnixNano()))
+
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", url, err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		defer cancel()
+
+		_ = database.Drop(ctx)
+		_ = database.Client().Disconnect(ctx)
+	})
+
+	return database
+}
+
+// Returns a database on a client pointed at an address nothing listens on,
+// for tests of the context handling that need no server.
+func unreachableDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+
+	clientOptions := options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(30 * time.Second)
+	client, err := mongo.Connect(context.Background(), clientOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = client.Disconnect(context.Background())
+	})
+
+	return client.Database("mongodbutilities_test")
+}
+
+// Inserts the documents through the driver, bypassing the helpers under test.
+func seedDocuments(t testing.TB, database *mongo.Database, collectionName string, documents ...interface{}) {
+	t.Helper()
+
+	_, err := database.Collection(collectionName).InsertMany(context.Background(), documents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCtxHelpersHonorCancellation(t *testing.T) {
+	database := unreachableDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := InsertDocumentCtx(ctx, database, "items", bson.M{"name": "a"})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("InsertDocumentCtx: got %v, want context.Canceled", err)
+	}
+
+	_, err = GetDocumentsCtx(ctx, database, "items", CreateQuery())
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("GetDocumentsCtx: got %v, want context.Canceled", err)
+	}
+
+	_, err = CountDocumentsCtx(ctx, database, "items", CreateQuery())
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("CountDocumentsCtx: got %v, want context.Canceled", err)
+	}
+}
+
+func TestCtxHelpersHonorDeadline(t *testing.T) {
+	database := unreachableDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel()
+
+	start := time.Now()
+	_, err := UpdateDocumentCtx(ctx, database, "items", CreateQuery(bson.M{"name": "a"}), bson.M{"$set": bson.M{"n": 1}})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the deadline was not propagated, the call took %v", elapsed)
+	}
+}
+
+func TestCtxHelpersRoundTrip(t *testing.T) {
+	database := testDatabase(t)
+	ctx := context.Background()
+
+	_, err := InsertDocumentCtx(ctx, database, "items", bson.M{"name": "a"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := CountDocumentsCtx(ctx, database, "items", CreateQuery(bson.M{"name": "a"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want 1", count)
+	}
+}
+
+// Sets DefaultTimeout for the duration of the test.
+func setTestTimeout(t *testing.T, timeout time.Duration) {
+	previous := DefaultTimeout
+	SetDefaultTimeout(timeout)
+
+	t.Cleanup(func() {
+		SetDefaultTimeout(previous)
+	})
+}
+
+func TestSetDefaultTimeout(t *testing.T) {
+	setTestTimeout(t, 50*time.Millisecond)
+
+	if DefaultTimeout != 50*time.Millisecond {
+		t.Fatalf("got DefaultTimeout %v, want 50ms", DefaultTimeout)
+	}
+
+	// Server selection never succeeds, only the default timeout ends the call.
+	database := unreachableDatabase(t)
+	start := time.Now()
+	_, err := InsertDocument(database, "items", bson.M{"name": "a"})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the default timeout was not applied, the call took %v", elapsed)
+	}
+}
+
+// Round trips the filter through BSON so filters built from different Go types compare equal.
+func normalizeFilter(t *testing.T, filter interface{}) bson.M {
+	t.Helper()
+
+	raw, err := bson.Marshal(filter)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var normalized bson.M
+	err = bson.Unmarshal(raw, &normalized)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return normalized
+}
+
+// Fails the test unless both filters hold the same BSON document.
+func assertFilter(t *testing.T, got, want interface{}) {
+	t.Helper()
+
+	if !reflect.DeepEqual(normalizeFilter(t, got), normalizeFilter(t, want)) {
+		t.Errorf("got filter %v, want %v", got, want)
+	}
+}
+
+func TestOrComposesIntoTheAndChain(t *testing.T) {
+	x, a, b, c := bson.M{"x": 1}, bson.M{"a": 1}, bson.M{"b": 1}, bson.M{"c": 1}
+	query := CreateQuery(x).Or(a, b).Filter(c)
+
+	assertFilter(t, query.Build(nil), bson.M{"$and": bson.A{x, bson.M{"$or": bson.A{a, b}}, c}})
+}
+
+func TestOrWithoutFiltersIsIgnored(t *testing.T) {
+	query := CreateQuery(bson.M{"x": 1}).Or()
+
+	if len(query.Query) != 1 {
+		t.Errorf("got %d filters, want the empty Or() to add none", len(query.Query))
+	}
+}
+
+func TestOrNestedWithExclude(t *testing.T) {
+	a, b, c := bson.M{"a": 1}, bson.M{"b": 1}, bson.M{"c": 1}
+	query := CreateQuery().
+		Exclude(a).
+		Or(b, bson.M{"$nor": bson.A{c}})
+
+	assertFilter(t, query.Build(nil), bson.M{"$and": bson.A{
+		bson.M{"$nor": bson.A{a}},
+		bson.M{"$or": bson.A{b, bson.M{"$nor": bson.A{c}}}},
+	}})
+}
+
+func TestBuildWithoutFilters(t *testing.T) {
+	assertFilter(t, CreateQuery().Build(nil), bson.M{})
+	assertFilter(t, CreateQuery(bson.M{}, bson.M{}).Build(nil), bson.M{})
+}
+
+func TestBuildWithOneFilter(t *testing.T) {
+	assertFilter(t, CreateQuery(bson.M{}, bson.M{"a": 1}).Build(nil), bson.M{"a": 1})
+}
+
+func TestBuildWithManyFilters(t *testing.T) {
+	query := CreateQuery(bson.M{"a": 1}, bson.M{}, bson.M{"b": 2})
+
+	assertFilter(t, query.Build(nil), bson.M{"$and": bson.A{bson.M{"a": 1}, bson.M{"b": 2}}})
+}
+
+func TestUnfilteredQueryMatchesEveryDocument(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"n": 1}, bson.M{"n": 2})
+
+	count, err := CountDocuments(database, "items", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Errorf("got %d documents, want 2", count)
+	}
+}
+
+func TestProjectSetsTheProjection(t *testing.T) {
+	projection := bson.M{"name": 1, "_id": 0}
+	query := CreateQuery(bson.M{"a": 1}).Project(projection).Limit(10)
+
+	if !reflect.DeepEqual(query.FindOptions.Projection, projection) {
+		t.Errorf("got projection %v, want %v", query.FindOptions.Projection, projection)
+	}
+
+	if query.FindOptions.Limit == nil || *query.FindOptions.Limit != 10 {
+		t.Errorf("got limit %v, want 10", query.FindOptions.Limit)
+	}
+
+	if !reflect.DeepEqual(query.FindOneOptions().Projection, projection) {
+		t.Errorf("got FindOne projection %v, want %v", query.FindOneOptions().Projection, projection)
+	}
+}
+
+func TestGetDocumentHonorsProjection(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann", "email": "ann@example.com"})
+
+	res, err := GetDocument(database, "users", CreateQuery(bson.M{"name": "ann"}).Project(bson.M{"name": 1, "_id": 0}))
+
+	if err != nil || res == nil {
+		t.Fatalf("got %v, %v", res, err)
+	}
+
+	var document bson.M
+	err = res.Decode(&document)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(document, bson.M{"name": "ann"}) {
+		t.Errorf("got %v, want only the name", document)
+	}
+}
+
+func TestFindOneOptionsCarriesSortAndSkip(t *testing.T) {
+	sort := bson.D{{Key: "created", Value: -1}}
+	findOneOptions := CreateQuery().Sort(sort).Skip(2).Limit(5).FindOneOptions()
+
+	assertFilter(t, findOneOptions.Sort, sort)
+
+	if findOneOptions.Skip == nil || *findOneOptions.Skip != 2 {
+		t.Errorf("got skip %v, want 2", findOneOptions.Skip)
+	}
+}
+
+func TestFindOneOptionsWithoutFindOptions(t *testing.T) {
+	findOneOptions := CreateQuery().FindOneOptions()
+
+	if findOneOptions == nil || findOneOptions.Sort != nil || findOneOptions.Projection != nil {
+		t.Errorf("got %+v, want empty options", findOneOptions)
+	}
+}
+
+func TestGetDocumentHonorsSort(t *testing.T) {
+	database := testDatabase(t)
+	now := time.Now().Truncate(time.Millisecond)
+	seedDocuments(t, database, "events",
+		bson.M{"name": "old", "created": now.Add(-2 * time.Hour)},
+		bson.M{"name": "new", "created": now},
+		bson.M{"name": "mid", "created": now.Add(-time.Hour)},
+	)
+
+	res, err := GetDocument(database, "events", CreateQuery().Sort(bson.D{{Key: "created", Value: -1}}))
+
+	if err != nil || res == nil {
+		t.Fatalf("got %v, %v", res, err)
+	}
+
+	var document bson.M
+	err = res.Decode(&document)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if document["name"] != "new" {
+		t.Errorf("got %v, want the newest document", document["name"])
+	}
+}
+
+func TestDecodeAllWithoutDocuments(t *testing.T) {
+	cursor, err := mongo.NewCursorFromDocuments(nil, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documents, err := DecodeAll[bson.M](cursor)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if documents == nil || len(documents) != 0 {
+		t.Errorf("got %v, want an empty slice", documents)
+	}
+}
+
+func TestDecodeAllDecodesEveryDocument(t *testing.T) {
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{bson.M{"n": 1}, bson.M{"n": 2}}, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documents, err := DecodeAll[struct {
+		N int `bson:"n"`
+	}](cursor)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(documents) != 2 || documents[0].N != 1 || documents[1].N != 2 {
+		t.Errorf("got %v, want n 1 and 2", documents)
+	}
+}
+
+func TestDecodeAllTypeMismatch(t *testing.T) {
+	cursor, err := mongo.NewCursorFromDocuments([]interface{}{bson.M{"n": "one"}}, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documents, err := DecodeAll[struct {
+		N int `bson:"n"`
+	}](cursor)
+
+	if err == nil {
+		t.Errorf("got %v, want a decode error", documents)
+	}
+
+	// The cursor is closed on the error path, so it cannot be advanced anymore.
+	if cursor.Next(context.Background()) {
+		t.Error("the cursor was left open")
+	}
+}
+
+func TestGetDocumentsTyped(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"n": 1}, bson.M{"n": 2}, bson.M{"n": 3})
+
+	documents, err := GetDocumentsTyped[struct {
+		N int `bson:"n"`
+	}](database, "items", CreateQuery(bson.M{"n": bson.M{"$gte": 2}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(documents) != 2 {
+		t.Errorf("got %v, want 2 documents", documents)
+	}
+
+	empty, err := GetDocumentsTyped[bson.M](database, "items", CreateQuery(bson.M{"n": 4}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if empty == nil || len(empty) != 0 {
+		t.Errorf("got %v, want an empty slice", empty)
+	}
+}
+
+func TestGetDocumentTyped(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann", "age": 31})
+
+	type user struct {
+		Name string `bson:"name"`
+		Age  int    `bson:"age"`
+	}
+
+	found, err := GetDocumentTyped[user](database, "users", CreateQuery(bson.M{"name": "ann"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found == nil || found.Age != 31 {
+		t.Errorf("got %v, want ann aged 31", found)
+	}
+
+	missing, err := GetDocumentTyped[user](database, "users", CreateQuery(bson.M{"name": "bob"}))
+
+	if missing != nil || err != nil {
+		t.Errorf("got %v, %v, want no document and no error", missing, err)
+	}
+
+	mismatched, err := GetDocumentTyped[struct {
+		Name int `bson:"name"`
+	}](database, "users", CreateQuery(bson.M{"name": "ann"}))
+
+	if mismatched != nil || err == nil {
+		t.Errorf("got %v, %v, want a decode error", mismatched, err)
+	}
+}
+
+// Model recording the timestamps SaveModel hands it.
+type testTimestampedUser struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Name      string             `bson:"name"`
+	CreatedAt time.Time          `bson:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at"`
+
+	createdCalls, updatedCalls int
+}
+
+func (instance *testTimestampedUser) GetID() primitive.ObjectID {
+	return instance.ID
+}
+
+func (instance *testTimestampedUser) SetID(id primitive.ObjectID) {
+	instance.ID = id
+}
+
+func (instance *testTimestampedUser) SetCreatedAt(createdAt time.Time) {
+	instance.CreatedAt = createdAt
+	instance.createdCalls++
+}
+
+func (instance *testTimestampedUser) SetUpdatedAt(updatedAt time.Time) {
+	instance.UpdatedAt = updatedAt
+	instance.updatedCalls++
+}
+
+// Reads the stored document with the _id value through the driver.
+func storedDocument(t *testing.T, database *mongo.Database, collectionName string, id interface{}) bson.M {
+	t.Helper()
+
+	var document bson.M
+	err := database.Collection(collectionName).FindOne(context.Background(), bson.M{"_id": id}).Decode(&document)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return document
+}
+
+func TestSaveModelSetsTimestamps(t *testing.T) {
+	database := testDatabase(t)
+	user := &testTimestampedUser{Name: "ann"}
+
+	err := SaveModel(user, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.createdCalls != 1 || user.updatedCalls != 1 || !user.CreatedAt.Equal(user.UpdatedAt) {
+		t.Errorf("insert: got %d/%d calls, created %v updated %v", user.createdCalls, user.updatedCalls, user.CreatedAt, user.UpdatedAt)
+	}
+
+	stored := storedDocument(t, database, "users", user.ID)
+
+	if stored["created_at"].(primitive.DateTime).Time().IsZero() {
+		t.Errorf("the creation time was not persisted: %v", stored)
+	}
+
+	createdAt := stored["created_at"]
+	time.Sleep(5 * time.Millisecond)
+	user.Name = "anne"
+	err = SaveModel(user, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.createdCalls != 1 || user.updatedCalls != 2 {
+		t.Errorf("update: got %d/%d calls, want 1/2", user.createdCalls, user.updatedCalls)
+	}
+
+	stored = storedDocument(t, database, "users", user.ID)
+
+	if stored["created_at"] != createdAt {
+		t.Errorf("the update changed the creation time from %v to %v", createdAt, stored["created_at"])
+	}
+
+	if !stored["updated_at"].(primitive.DateTime).Time().After(createdAt.(primitive.DateTime).Time()) {
+		t.Errorf("the update time %v was not persisted", stored["updated_at"])
+	}
+}
+
+// Model marked as deleted instead of being removed.
+type testNote struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Text      string             `bson:"text"`
+	DeletedAt time.Time          `bson:"deleted_at,omitempty"`
+}
+
+func (instance *testNote) GetID() primitive.ObjectID {
+	return instance.ID
+}
+
+func (instance *testNote) SetID(id primitive.ObjectID) {
+	instance.ID = id
+}
+
+func (instance *testNote) SetDeletedAt(deletedAt time.Time) {
+	instance.DeletedAt = deletedAt
+}
+
+func TestExcludeDeletedFilter(t *testing.T) {
+	assertFilter(t, CreateQuery().ExcludeDeleted().Build(nil), bson.M{"deleted": bson.M{"$ne": true}})
+}
+
+func TestDeleteModelSoft(t *testing.T) {
+	database := testDatabase(t)
+	note := &testNote{Text: "draft"}
+	kept := &testNote{Text: "kept"}
+
+	for _, model := range []*testNote{note, kept} {
+		err := SaveModel(model, database, "notes")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := DeleteModelSoft(note, database, "notes")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if note.DeletedAt.IsZero() {
+		t.Error("the model's deletion time was not set")
+	}
+
+	stored := storedDocument(t, database, "notes", note.ID)
+
+	if stored["deleted"] != true || stored["deleted_at"] == nil {
+		t.Errorf("got %v, want the document marked as deleted", stored)
+	}
+
+	count, err := CountDocuments(database, "notes", CreateQuery().ExcludeDeleted())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want the soft deleted one excluded", count)
+	}
+}
+
+func TestUpsertSetsTheUpdateOption(t *testing.T) {
+	query := CreateQuery().Upsert(true)
+
+	if query.UpdateOptions.Upsert == nil || !*query.UpdateOptions.Upsert {
+		t.Errorf("got upsert %v, want true", query.UpdateOptions.Upsert)
+	}
+}
+
+func TestUpdateDocumentUpserts(t *testing.T) {
+	database := testDatabase(t)
+
+	res, err := UpdateDocument(database, "items", CreateQuery(bson.M{"name": "new"}).Upsert(true), bson.M{"$set": bson.M{"n": 1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UpsertedID == nil {
+		t.Errorf("got %+v, want an upserted document", res)
+	}
+
+	res, err = UpdateDocuments(database, "items", CreateQuery(bson.M{"name": "other"}).Upsert(true), bson.M{"$set": bson.M{"n": 2}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UpsertedID == nil {
+		t.Errorf("got %+v, want UpdateDocuments to upsert too", res)
+	}
+}
+
+// Skips the test when the server reports the feature it exercises as not implemented,
+// as some MongoDB compatible servers do.
+func skipIfNotImplemented(t *testing.T, err error) {
+	t.Helper()
+
+	var serverError mongo.ServerError
+
+	if errors.As(err, &serverError) && serverError.HasErrorCode(238) {
+		t.Skipf("not implemented by the server: %v", err)
+	}
+}
+
+// Case insensitive collation, so "ann" matches "Ann".
+var caseInsensitive = &options.Collation{Locale: "en", Strength: 2}
+
+func TestUpdateHelpersForwardTheCollation(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "Ann"}, bson.M{"name": "ANN"})
+
+	query := CreateQuery(bson.M{"name": "ann"})
+	query.UpdateOptions = options.Update().SetCollation(caseInsensitive)
+	res, err := UpdateDocument(database, "users", query, bson.M{"$set": bson.M{"one": true}})
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MatchedCount != 1 {
+		t.Errorf("UpdateDocument: matched %d documents, want 1", res.MatchedCount)
+	}
+
+	res, err = UpdateDocuments(database, "users", query, bson.M{"$set": bson.M{"all": true}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MatchedCount != 2 {
+		t.Errorf("UpdateDocuments: matched %d documents, want 2", res.MatchedCount)
+	}
+
+	// Without the collation the filter is case sensitive.
+	res, err = UpdateDocuments(database, "users", CreateQuery(bson.M{"name": "ann"}), bson.M{"$set": bson.M{"all": false}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MatchedCount != 0 {
+		t.Errorf("without collation: matched %d documents, want 0", res.MatchedCount)
+	}
+}
+
+func TestDeleteHelpersForwardTheCollation(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "Ann"}, bson.M{"name": "ANN"}, bson.M{"name": "aNn"})
+
+	query := CreateQuery(bson.M{"name": "ann"})
+	query.DeleteOptions = options.Delete().SetCollation(caseInsensitive)
+	res, err := DeleteDocument(database, "users", query)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 1 {
+		t.Errorf("DeleteDocument: deleted %d documents, want 1", res.DeletedCount)
+	}
+
+	res, err = DeleteDocuments(database, "users", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 2 {
+		t.Errorf("DeleteDocuments: deleted %d documents, want 2", res.DeletedCount)
+	}
+}
+
+func TestReturnUpdatedSetsTheReturnDocument(t *testing.T) {
+	after := CreateQuery().ReturnUpdated(true).FindOneAndUpdateOptions()
+
+	if after.ReturnDocument == nil || *after.ReturnDocument != options.After {
+		t.Errorf("got %v, want options.After", after.ReturnDocument)
+	}
+
+	before := CreateQuery().ReturnUpdated(false).FindOneAndUpdateOptions()
+
+	if before.ReturnDocument == nil || *before.ReturnDocument != options.Before {
+		t.Errorf("got %v, want options.Before", before.ReturnDocument)
+	}
+}
+
+func TestFindAndUpdateDocument(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "counters", bson.M{"name": "hits", "n": 1})
+
+	var counter struct {
+		N int `bson:"n"`
+	}
+	increment := bson.M{"$inc": bson.M{"n": 1}}
+
+	res, err := FindAndUpdateDocument(database, "counters", CreateQuery(bson.M{"name": "hits"}).ReturnUpdated(false), increment)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = res.Decode(&counter); err != nil || counter.N != 1 {
+		t.Errorf("before: got %d, %v, want 1", counter.N, err)
+	}
+
+	res, err = FindAndUpdateDocument(database, "counters", CreateQuery(bson.M{"name": "hits"}).ReturnUpdated(true), increment)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = res.Decode(&counter); err != nil || counter.N != 3 {
+		t.Errorf("after: got %d, %v, want 3", counter.N, err)
+	}
+
+	res, err = FindAndUpdateDocument(database, "counters", CreateQuery(bson.M{"name": "misses"}), increment)
+
+	if res != nil || err != nil {
+		t.Errorf("no match: got %v, %v, want nil, nil", res, err)
+	}
+
+	res, err = FindAndUpdateDocument(database, "counters", CreateQuery(bson.M{"name": "misses"}).Upsert(true).ReturnUpdated(true), increment)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = res.Decode(&counter); err != nil || counter.N != 1 {
+		t.Errorf("upsert: got %d, %v, want 1", counter.N, err)
+	}
+}
+
+func TestFindAndDeleteDocumentPopsInSortedOrder(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "queue", bson.M{"n": 2}, bson.M{"n": 3}, bson.M{"n": 1})
+
+	for _, want := range []int{1, 2, 3} {
+		res, err := FindAndDeleteDocument(database, "queue", CreateQuery().Sort(bson.M{"n": 1}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var entry struct {
+			N int `bson:"n"`
+		}
+
+		if err = res.Decode(&entry); err != nil || entry.N != want {
+			t.Errorf("got %d, %v, want %d", entry.N, err, want)
+		}
+	}
+
+	res, err := FindAndDeleteDocument(database, "queue", CreateQuery())
+
+	if res != nil || err != nil {
+		t.Errorf("empty queue: got %v, %v, want nil, nil", res, err)
+	}
+}
+
+func TestReplaceOptionsCarriesTheUpsert(t *testing.T) {
+	replaceOptions := CreateQuery().Upsert(true).ReplaceOptions()
+
+	if replaceOptions.Upsert == nil || !*replaceOptions.Upsert {
+		t.Errorf("got upsert %v, want true", replaceOptions.Upsert)
+	}
+}
+
+func TestReplaceDocumentRemovesOmittedFields(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann", "age": 31, "city": "Oslo"})
+
+	res, err := ReplaceDocument(database, "users", CreateQuery(bson.M{"name": "ann"}), bson.M{"name": "ann", "age": 32})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.ModifiedCount != 1 {
+		t.Errorf("modified %d documents, want 1", res.ModifiedCount)
+	}
+
+	document, err := GetDocument(database, "users", CreateQuery(bson.M{"name": "ann"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored bson.M
+
+	if err = document.Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := stored["city"]; found || stored["age"] != int32(32) {
+		t.Errorf("got %v, want the replacement only", stored)
+	}
+
+	res, err = ReplaceDocument(database, "users", CreateQuery(bson.M{"name": "bob"}).Upsert(true), bson.M{"name": "bob"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UpsertedID == nil {
+		t.Errorf("got %+v, want an upserted document", res)
+	}
+}
+
+func TestBulkBuilderMixedOperations(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"name": "a"}, bson.M{"name": "b"}, bson.M{"name": "c"})
+
+	res, err := CreateBulk().
+		InsertOne(bson.M{"name": "d"}).
+		UpdateOne(CreateQuery(bson.M{"name": "a"}), bson.M{"$set": bson.M{"n": 1}}).
+		DeleteOne(CreateQuery(bson.M{"name": "b"})).
+		ReplaceOne(CreateQuery(bson.M{"name": "c"}), bson.M{"name": "c", "replaced": true}).
+		Execute(database, "items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.InsertedCount != 1 || res.MatchedCount != 2 || res.ModifiedCount != 2 || res.DeletedCount != 1 {
+		t.Errorf("got %+v, want 1 insert, 2 updates and 1 delete", res)
+	}
+}
+
+func TestBulkBuilderOrderedStopsAtTheFirstFailure(t *testing.T) {
+	for _, ordered := range []bool{true, false} {
+		database := testDatabase(t)
+		seedDocuments(t, database, "items", bson.M{"_id": 1})
+
+		res, err := CreateBulk().
+			Ordered(ordered).
+			InsertOne(bson.M{"_id": 1}).
+			InsertOne(bson.M{"_id": 2}).
+			Execute(database, "items")
+
+		var bulkError mongo.BulkWriteException
+
+		if !errors.As(err, &bulkError) {
+			t.Fatalf("ordered %v: got %v, want a BulkWriteException", ordered, err)
+		}
+
+		want := int64(0)
+
+		if !ordered {
+			want = 1
+		}
+
+		if res.InsertedCount != want {
+			t.Errorf("ordered %v: inserted %d documents, want %d", ordered, res.InsertedCount, want)
+		}
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"items",
+		bson.M{"category": "a", "n": 1},
+		bson.M{"category": "a", "n": 2},
+		bson.M{"category": "b", "n": 3},
+		bson.M{"category": "c", "n": 0},
+	)
+
+	values, err := DistinctValues(database, "items", "category", CreateQuery(bson.M{"n": bson.M{"$gt": 0}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 {
+		t.Errorf("got %v, want a and b", values)
+	}
+
+	categories, err := DistinctTyped[string](database, "items", "category", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(categories)
+
+	if len(categories) != 3 || categories[0] != "a" || categories[1] != "b" || categories[2] != "c" {
+		t.Errorf("got %v, want a, b and c", categories)
+	}
+
+	none, err := DistinctTyped[string](database, "items", "category", CreateQuery(bson.M{"n": 10}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if none == nil || len(none) != 0 {
+		t.Errorf("got %v, want an empty slice", none)
+	}
+}
+
+func TestAggregateTypedGroup(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"orders",
+		bson.M{"customer": "ann", "total": 10},
+		bson.M{"customer": "ann", "total": 5},
+		bson.M{"customer": "bob", "total": 7},
+	)
+
+	type customerTotal struct {
+		Customer string `bson:"_id"`
+		Total    int    `bson:"total"`
+	}
+
+	totals, err := AggregateTyped[customerTotal](database, "orders", mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$customer", "total": bson.M{"$sum": "$total"}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []customerTotal{{"ann", 15}, {"bob", 7}}
+
+	if len(totals) != 2 || totals[0] != want[0] || totals[1] != want[1] {
+		t.Errorf("got %v, want %v", totals, want)
+	}
+}
+
+// Lists the operator of every stage of the pipeline, in order.
+func stageNames(pipeline mongo.Pipeline) []string {
+	names := make([]string, len(pipeline))
+
+	for i_, stage := range pipeline {
+		names[i_] = stage[0].Key
+	}
+
+	return names
+}
+
+func TestAggregateSetStageOrder(t *testing.T) {
+	pipeline := CreateAggregate().
+		Match(CreateQuery(bson.M{"status": "paid"})).
+		Lookup("customers", "customer", "_id", "customer").
+		Group(bson.M{"_id": "$customer", "total": bson.M{"$sum": "$total"}}).
+		Sort(bson.M{"total": -1}).
+		Skip(10).
+		Limit(5).
+		Project(bson.M{"total": 1}).
+		Build(nil)
+
+	want := []string{"$match", "$lookup", "$group", "$sort", "$skip", "$limit", "$project"}
+	got := stageNames(pipeline)
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	for i_ := range want {
+		if got[i_] != want[i_] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	assertFilter(t, pipeline[0][0].Value, bson.M{"status": "paid"})
+
+	if pipeline[4][0].Value != int64(10) || pipeline[5][0].Value != int64(5) {
+		t.Errorf("got skip %v and limit %v, want 10 and 5", pipeline[4][0].Value, pipeline[5][0].Value)
+	}
+}
+
+func TestAggregateSetRuns(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "orders", bson.M{"status": "paid", "n": 1}, bson.M{"status": "open", "n": 2}, bson.M{"status": "paid", "n": 3})
+
+	pipeline := CreateAggregate().
+		Match(CreateQuery(bson.M{"status": "paid"})).
+		Sort(bson.M{"n": -1}).
+		Limit(1).
+		Build(database)
+	results, err := AggregateTyped[bson.M](database, "orders", pipeline)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0]["n"] != int32(3) {
+		t.Errorf("got %v, want the paid order 3", results)
+	}
+}
+
+func TestCreateIndexesIsNotUnique(t *testing.T) {
+	database := testDatabase(t)
+
+	err := CreateIndexes(database, "users", IndexField{Field: "name", Ascending: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocuments(database, "users", []interface{}{bson.M{"name": "ann"}, bson.M{"name": "ann"}})
+
+	if err != nil {
+		t.Errorf("got %v, want duplicates to be accepted", err)
+	}
+}
+
+func TestCreateUniqueIndexesRejectsDuplicates(t *testing.T) {
+	database := testDatabase(t)
+
+	err := CreateUniqueIndexes(database, "users", IndexField{Field: "email", Ascending: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocument(database, "users", bson.M{"email": "ann@example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocument(database, "users", bson.M{"email": "ann@example.com"})
+
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("got %v, want a duplicate key error", err)
+	}
+}
+
+func TestCreateIndexWithOptionsReturnsTheName(t *testing.T) {
+	database := testDatabase(t)
+
+	name, err := CreateIndexWithOptions(
+		database,
+		"users",
+		options.Index().SetName("by_age"),
+		IndexField{Field: "age", Ascending: false},
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "by_age" {
+		t.Errorf("got %q, want by_age", name)
+	}
+}
+
+// Returns the driver's listing of the collection's index with the name.
+func listedIndex(t *testing.T, database *mongo.Database, collectionName, name string) bson.D {
+	t.Helper()
+
+	cursor, err := database.Collection(collectionName).Indexes().List(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var indexes []bson.D
+
+	if err = cursor.All(context.Background(), &indexes); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, index := range indexes {
+		if index.Map()["name"] == name {
+			return index
+		}
+	}
+
+	t.Fatalf("no index %q in %v", name, indexes)
+
+	return nil
+}
+
+func TestCreateCompoundIndexKeepsTheKeyOrder(t *testing.T) {
+	database := testDatabase(t)
+
+	name, err := CreateCompoundIndex(
+		database,
+		"events",
+		bson.D{{Key: "user", Value: 1}, {Key: "at", Value: -1}, {Key: "kind", Value: 1}},
+		nil,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := listedIndex(t, database, "events", name).Map()["key"].(bson.D)
+	want := []string{"user", "at", "kind"}
+
+	if len(keys) != len(want) {
+		t.Fatalf("got keys %v, want %v", keys, want)
+	}
+
+	for i_, key := range keys {
+		if key.Key != want[i_] {
+			t.Errorf("got keys %v, want %v", keys, want)
+		}
+	}
+}
+
+func TestCreateTTLIndexSetsTheExpiry(t *testing.T) {
+	database := testDatabase(t)
+
+	name, err := CreateTTLIndex(database, "sessions", "created_at", 90*time.Minute)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := listedIndex(t, database, "sessions", name).Map()
+	expiry, found := index["expireAfterSeconds"]
+
+	if !found {
+		t.Fatalf("got %v, want expireAfterSeconds", index)
+	}
+
+	if seconds, ok := expiry.(int32); !ok || seconds != 5400 {
+		t.Errorf("got expireAfterSeconds %v, want 5400", expiry)
+	}
+}
+
+func TestCreateTTLIndexRejectsInvalidExpiries(t *testing.T) {
+	database := unreachableDatabase(t)
+
+	for name, expireAfter := range map[string]time.Duration{
+		"negative":   -time.Second,
+		"sub-second": 500 * time.Millisecond,
+		"too long":   (math.MaxInt32 + 1) * time.Second,
+	} {
+		_, err := CreateTTLIndex(database, "sessions", "created_at", expireAfter)
+
+		if !errors.Is(err, ErrInvalidExpiry) {
+			t.Errorf("%s: got %v, want ErrInvalidExpiry", name, err)
+		}
+	}
+}
+
+// Skips the test when the server lacks the kind of index(text, 2dsphere...) it needs,
+// some compatible servers report such indexes as missing right after creating them.
+func skipIfIndexUnsupported(t *testing.T, err error) {
+	t.Helper()
+	skipIfNotImplemented(t, err)
+
+	var serverError mongo.ServerError
+
+	if errors.As(err, &serverError) && serverError.HasErrorCode(27) {
+		t.Skipf("the index is not supported by the server: %v", err)
+	}
+}
+
+func TestSearchAddsTheTextFilter(t *testing.T) {
+	assertFilter(t, CreateQuery(bson.M{"published": true}).Search("mongo").Build(nil), bson.M{
+		"$and": []interface{}{
+			bson.M{"published": true},
+			bson.M{"$text": bson.M{"$search": "mongo"}},
+		},
+	})
+}
+
+func TestSortByTextScoreKeepsTheProjection(t *testing.T) {
+	query := CreateQuery().Project(bson.M{"title": 1}).SortByTextScore()
+
+	assertFilter(t, query.FindOptions.Projection, bson.M{"title": 1, "score": bson.M{"$meta": "textScore"}})
+	assertFilter(t, query.FindOptions.Sort, bson.M{"score": bson.M{"$meta": "textScore"}})
+}
+
+func TestSearchRanksByRelevance(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"articles",
+		bson.M{"title": "a", "description": "cooking with rice"},
+		bson.M{"title": "b", "description": "mongo indexes and mongo queries with mongo"},
+		bson.M{"title": "c", "description": "a short note on mongo"},
+	)
+
+	_, err := CreateTextIndex(database, "articles", "description")
+	skipIfIndexUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := GetDocumentsTyped[bson.M](database, "articles", CreateQuery().Search("mongo").SortByTextScore())
+	skipIfIndexUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 || results[0]["title"] != "b" || results[1]["title"] != "c" {
+		t.Errorf("got %v, want b ranked above c", results)
+	}
+}
+
+func TestSearchWithoutATextIndexFails(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "articles", bson.M{"description": "mongo"})
+
+	_, err := GetDocumentsTyped[bson.M](database, "articles", CreateQuery().Search("mongo"))
+	skipIfNotImplemented(t, err)
+
+	if err == nil {
+		t.Error("got no error, want the driver's missing text index error")
+	}
+}
+
+// Lists the names of the collection's indexes.
+func indexNames(t *testing.T, database *mongo.Database, collectionName string) map[string]bson.M {
+	t.Helper()
+
+	indexes, err := ListIndexes(database, collectionName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bson.M{}
+
+	for _, index := range indexes {
+		names[index["name"].(string)] = index
+	}
+
+	return names
+}
+
+func TestIndexesRoundTrip(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann"})
+
+	name, err := CreateCompoundIndex(database, "users", bson.D{{Key: "name", Value: 1}, {Key: "age", Value: -1}}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CreateCompoundIndex(database, "users", bson.D{{Key: "email", Value: 1}}, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes := indexNames(t, database, "users")
+
+	if len(indexes) != 3 {
+		t.Fatalf("got %v, want the _id index and two others", indexes)
+	}
+
+	assertFilter(t, indexes[name]["key"], bson.M{"name": 1, "age": -1})
+
+	if err = DropIndex(database, "users", name); err != nil {
+		t.Fatal(err)
+	}
+
+	if indexes = indexNames(t, database, "users"); len(indexes) != 2 || indexes[name] != nil {
+		t.Errorf("got %v, want %s dropped", indexes, name)
+	}
+
+	if err = DropAllIndexes(database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if indexes = indexNames(t, database, "users"); len(indexes) != 1 || indexes["_id_"] == nil {
+		t.Errorf("got %v, want the _id index only", indexes)
+	}
+}
+
+func TestPingDatabase(t *testing.T) {
+	if err := PingDatabase(testDatabase(t), 5*time.Second); err != nil {
+		t.Errorf("got %v, want the server to answer", err)
+	}
+}
+
+func TestPingDatabaseFailsPromptly(t *testing.T) {
+	database := unreachableDatabase(t)
+	start := time.Now()
+
+	if err := PingDatabase(database, 100*time.Millisecond); err == nil {
+		t.Error("got no error, want the unreachable server reported")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the ping took %v", elapsed)
+	}
+}
+
+func TestCloseDatabase(t *testing.T) {
+	database := testDatabase(t)
+
+	_, err := InsertDocument(database, "items", bson.M{"name": "a"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = CloseDatabase(database, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocument(database, "items", bson.M{"name": "b"})
+
+	if !errors.Is(err, mongo.ErrClientDisconnected) {
+		t.Errorf("got %v, want mongo.ErrClientDisconnected", err)
+	}
+}
+
+func TestGetDatabaseVerifiesTheConnection(t *testing.T) {
+	url := os.Getenv("MONGODB_TEST_URI")
+
+	if url == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	database, err := GetDatabaseWithTimeout(url, "mongodbutilities_test", 10*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = CloseDatabase(database, 5*time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetDatabaseReportsATimeout(t *testing.T) {
+	start := time.Now()
+	database, err := GetDatabaseWithTimeout("mongodb://127.0.0.1:1", "mongodbutilities_test", 200*time.Millisecond)
+
+	if database != nil || !errors.Is(err, ErrConnectionTimeout) {
+		t.Errorf("got %v, %v, want ErrConnectionTimeout", database, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the connection attempt took %v", elapsed)
+	}
+}
+
+func TestGetDatabaseReportsAnUnknownHost(t *testing.T) {
+	database, err := GetDatabaseWithTimeout("mongodb://mongodbutilities.invalid:27017", "mongodbutilities_test", 5*time.Second)
+
+	if database != nil || !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("got %v, %v, want ErrHostNotFound", database, err)
+	}
+}
+
+func TestGetDatabaseWithOptionsAppliesThem(t *testing.T) {
+	url := os.Getenv("MONGODB_TEST_URI")
+
+	if url == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	var lock sync.Mutex
+	var maxPoolSizes []uint64
+	monitor := &event.PoolMonitor{
+		Event: func(poolEvent *event.PoolEvent) {
+			if poolEvent.Type == event.PoolCreated && poolEvent.PoolOptions != nil {
+				lock.Lock()
+				maxPoolSizes = append(maxPoolSizes, poolEvent.PoolOptions.MaxPoolSize)
+				lock.Unlock()
+			}
+		},
+	}
+
+	database, err := GetDatabaseWithOptions(
+		url,
+		"mongodbutilities_test",
+		options.Client().SetMaxPoolSize(7).SetPoolMonitor(monitor),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer CloseDatabase(database, 5*time.Second)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if len(maxPoolSizes) == 0 {
+		t.Fatal("no connection pool was created")
+	}
+
+	for _, maxPoolSize := range maxPoolSizes {
+		if maxPoolSize != 7 {
+			t.Errorf("got a max pool size of %d, want 7", maxPoolSize)
+		}
+	}
+}
+
+func TestReadFromSecondarySetsTheReadPreference(t *testing.T) {
+	query := CreateQuery().ReadFromSecondary()
+
+	if query.CollectionOptions == nil || query.CollectionOptions.ReadPreference == nil {
+		t.Fatal("no read preference was set")
+	}
+
+	if mode := query.CollectionOptions.ReadPreference.Mode(); mode != readpref.SecondaryPreferredMode {
+		t.Errorf("got mode %v, want secondaryPreferred", mode)
+	}
+
+	query.ReadPreference(readpref.Nearest())
+
+	if mode := query.CollectionOptions.ReadPreference.Mode(); mode != readpref.NearestMode {
+		t.Errorf("got mode %v, want nearest", mode)
+	}
+}
+
+func TestReadPreferenceIsUsedByTheReads(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"n": 1}, bson.M{"n": 2})
+
+	// A standalone server answers secondaryPreferred reads itself.
+	documents, err := GetDocumentsTyped[bson.M](database, "items", CreateQuery().ReadFromSecondary())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(documents) != 2 {
+		t.Errorf("got %v, want 2 documents", documents)
+	}
+}
+
+// Skips the test unless the server is a replica set member or a mongos, as transactions and change streams need.
+func requireReplicaSet(t *testing.T, database *mongo.Database) {
+	t.Helper()
+
+	var hello bson.M
+	err := database.RunCommand(context.Background(), bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello["setName"] == nil && hello["msg"] != "isdbgrid" {
+		t.Skip("the server is neither a replica set member nor a mongos")
+	}
+}
+
+func TestWithTransactionCommits(t *testing.T) {
+	database := testDatabase(t)
+	requireReplicaSet(t, database)
+	seedDocuments(t, database, "accounts", bson.M{"name": "ann", "balance": 10})
+
+	err := WithTransaction(database, func(ctx mongo.SessionContext) error {
+		_, err := UpdateDocumentCtx(ctx, database, "accounts", CreateQuery(bson.M{"name": "ann"}), bson.M{"$inc": bson.M{"balance": -5}})
+
+		if err != nil {
+			return err
+		}
+
+		_, err = InsertDocumentCtx(ctx, database, "accounts", bson.M{"name": "bob", "balance": 5})
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := CountDocuments(database, "accounts", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Errorf("got %d accounts, want 2", count)
+	}
+}
+
+func TestWithTransactionRollsBack(t *testing.T) {
+	database := testDatabase(t)
+	requireReplicaSet(t, database)
+	seedDocuments(t, database, "accounts", bson.M{"name": "ann", "balance": 10})
+	failure := errors.New("transfer rejected")
+
+	err := WithTransaction(database, func(ctx mongo.SessionContext) error {
+		_, err := UpdateDocumentCtx(ctx, database, "accounts", CreateQuery(bson.M{"name": "ann"}), bson.M{"$inc": bson.M{"balance": -5}})
+
+		if err != nil {
+			return err
+		}
+
+		_, err = InsertDocumentCtx(ctx, database, "accounts", bson.M{"name": "bob", "balance": 5})
+
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the callback's error", err)
+	}
+
+	accounts, err := GetDocumentsTyped[bson.M](database, "accounts", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accounts) != 1 || accounts[0]["balance"] != int32(10) {
+		t.Errorf("got %v, want no partial writes", accounts)
+	}
+}
+
+// Creates the collections through the driver.
+func createCollections(t *testing.T, database *mongo.Database, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if err := database.CreateCollection(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListCollectionsFiltered(t *testing.T) {
+	database := testDatabase(t)
+	createCollections(t, database, "log_2024", "log_2025", "users")
+
+	names, err := ListCollectionsFiltered(database, bson.M{"name": bson.M{"$regex": "^log_"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+
+	if len(names) != 2 || names[0] != "log_2024" || names[1] != "log_2025" {
+		t.Errorf("got %v, want the log collections", names)
+	}
+
+	all, err := ListCollections(database)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 3 {
+		t.Errorf("got %v, want 3 collections", all)
+	}
+}
+
+func TestCollectionExists(t *testing.T) {
+	database := testDatabase(t)
+	createCollections(t, database, "users")
+
+	for name, want := range map[string]bool{"users": true, "user": false, "orders": false} {
+		exists, err := CollectionExists(database, name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != want {
+			t.Errorf("%s: got %v, want %v", name, exists, want)
+		}
+	}
+}
+
+// Seeds the collection with documents numbered 1 to count.
+func seedNumbered(t testing.TB, database *mongo.Database, collectionName string, count int) {
+	t.Helper()
+
+	documents := make([]interface{}, count)
+
+	for i_ := range documents {
+		documents[i_] = bson.M{"n": i_ + 1}
+	}
+
+	seedDocuments(t, database, collectionName, documents...)
+}
+
+type numbered struct {
+	N int `bson:"n"`
+}
+
+func TestPaginateAcrossPages(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 7)
+	query := CreateQuery(bson.M{"n": bson.M{"$gt": 0}}).Sort(bson.M{"n": 1})
+
+	for page, want := range map[int][]int{1: {1, 2, 3}, 2: {4, 5, 6}, 3: {7}, 4: {}} {
+		result, err := Paginate[numbered](database, "items", query, page, 3)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Total != 7 || result.TotalPages != 3 || result.Page != page || result.PageSize != 3 {
+			t.Errorf("page %d: got %+v, want 7 documents over 3 pages", page, result)
+		}
+
+		if len(result.Items) != len(want) {
+			t.Fatalf("page %d: got %v, want %v", page, result.Items, want)
+		}
+
+		for i_, item := range result.Items {
+			if item.N != want[i_] {
+				t.Errorf("page %d: got %v, want %v", page, result.Items, want)
+			}
+		}
+	}
+
+	if query.FindOptions.Skip != nil || query.FindOptions.Limit != nil {
+		t.Error("the QuerySet was modified")
+	}
+}
+
+func TestPaginateClampsThePage(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 2)
+
+	result, err := Paginate[numbered](database, "items", CreateQuery().Sort(bson.M{"n": 1}), 0, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Page != 1 || len(result.Items) != 1 || result.Items[0].N != 1 {
+		t.Errorf("got %+v, want the first page", result)
+	}
+}
+
+func TestPaginateRejectsAnEmptyPageSize(t *testing.T) {
+	_, err := Paginate[numbered](unreachableDatabase(t), "items", CreateQuery(), 1, 0)
+
+	if !errors.Is(err, ErrInvalidPageSize) {
+		t.Errorf("got %v, want ErrInvalidPageSize", err)
+	}
+}
+
+func TestPaginateAfterBuildsTheKeysetQuery(t *testing.T) {
+	query := CreateQuery(bson.M{"kind": "post"})
+	PaginateAfter(query, "n", 10, 5)
+
+	assertFilter(t, query.Build(nil), bson.M{
+		"$and": []interface{}{bson.M{"kind": "post"}, bson.M{"n": bson.M{"$gt": 10}}},
+	})
+	assertFilter(t, query.FindOptions.Sort, bson.M{"n": 1})
+
+	if query.FindOptions.Limit == nil || *query.FindOptions.Limit != 5 || query.FindOptions.Skip != nil {
+		t.Errorf("got limit %v and skip %v, want a limit of 5 and no skip", query.FindOptions.Limit, query.FindOptions.Skip)
+	}
+
+	first := CreateQuery()
+	PaginateAfter(first, "n", nil, 5)
+
+	assertFilter(t, first.Build(nil), bson.M{})
+}
+
+func TestGetDocumentsAfterIteratesForward(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 7)
+	query := CreateQuery()
+
+	var seen []int
+	var after interface{}
+
+	for pages := 0; pages < 10; pages++ {
+		items, last, err := GetDocumentsAfter[numbered](database, "items", query, "n", after, 3)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if last == nil {
+			if len(items) != 0 {
+				t.Errorf("got %v without a last value", items)
+			}
+
+			break
+		}
+
+		for _, item := range items {
+			seen = append(seen, item.N)
+		}
+
+		after = last
+	}
+
+	if len(seen) != 7 {
+		t.Fatalf("got %v, want 1 to 7", seen)
+	}
+
+	for i_, n := range seen {
+		if n != i_+1 {
+			t.Fatalf("got %v, want 1 to 7 in order", seen)
+		}
+	}
+
+	if len(query.Query) != 0 || query.FindOptions != nil {
+		t.Error("the QuerySet was modified")
+	}
+}
+
+// Pages through the seeded collection, skipping to each page or seeking past the previous one.
+func benchmarkPagination(b *testing.B, keyset bool) {
+	database := testDatabase(b)
+	seedNumbered(b, database, "items", 20000)
+
+	err := CreateIndexes(database, "items", IndexField{Field: "n", Ascending: true})
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+
+	for i_ := 0; i_ < b.N; i_++ {
+		// The last page, where skipping has to walk past every preceding document.
+		page := 199
+
+		if keyset {
+			_, _, err = GetDocumentsAfter[numbered](database, "items", CreateQuery(), "n", page*100, 100)
+		} else {
+			skip, limit := page*100, 100
+			query := CreateQuery().Sort(bson.M{"n": 1})
+			PaginateQuery(query, &skip, &limit)
+			_, err = GetDocumentsTyped[numbered](database, "items", query)
+		}
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPaginateWithSkip(b *testing.B) {
+	benchmarkPagination(b, false)
+}
+
+func BenchmarkPaginateAfter(b *testing.B) {
+	benchmarkPagination(b, true)
+}
+
+func TestInAndNotInFilters(t *testing.T) {
+	assertFilter(t, CreateQuery().In("n", 1, 2).NotIn("kind", "a").Build(nil), bson.M{
+		"$and": []interface{}{
+			bson.M{"n": bson.M{"$in": []interface{}{1, 2}}},
+			bson.M{"kind": bson.M{"$nin": []interface{}{"a"}}},
+		},
+	})
+}
+
+func TestInWithoutValuesMatchesNothing(t *testing.T) {
+	assertFilter(t, CreateQuery().In("n").Build(nil), bson.M{"n": bson.M{"$in": []interface{}{}}})
+	assertFilter(t, CreateQuery().NotIn("n").Build(nil), bson.M{"n": bson.M{"$nin": []interface{}{}}})
+
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 4)
+
+	for query, want := range map[*QuerySet]int64{
+		CreateQuery().In("n", 1, 3): 2,
+		CreateQuery().NotIn("n", 1): 3,
+		CreateQuery().In("n"):       0,
+		CreateQuery().NotIn("n"):    4,
+	} {
+		count, err := CountDocuments(database, "items", query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != want {
+			t.Errorf("%v: got %d documents, want %d", query.Build(nil), count, want)
+		}
+	}
+}
+
+func TestComparisonFilters(t *testing.T) {
+	query := CreateQuery().Eq("a", 1).Ne("b", 2).Gt("c", 3).Gte("d", 4).Lt("e", 5).Lte("f", 6)
+
+	assertFilter(t, query.Build(nil), bson.M{
+		"$and": []interface{}{
+			bson.M{"a": bson.M{"$eq": 1}},
+			bson.M{"b": bson.M{"$ne": 2}},
+			bson.M{"c": bson.M{"$gt": 3}},
+			bson.M{"d": bson.M{"$gte": 4}},
+			bson.M{"e": bson.M{"$lt": 5}},
+			bson.M{"f": bson.M{"$lte": 6}},
+		},
+	})
+}
+
+func TestBetweenIsInclusive(t *testing.T) {
+	database := testDatabase(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	seedDocuments(
+		t,
+		database,
+		"events",
+		bson.M{"name": "before", "at": start.Add(-time.Second)},
+		bson.M{"name": "start", "at": start},
+		bson.M{"name": "inside", "at": start.AddDate(0, 0, 10)},
+		bson.M{"name": "end", "at": end},
+		bson.M{"name": "after", "at": end.Add(time.Second)},
+	)
+
+	events, err := GetDocumentsTyped[bson.M](database, "events", CreateQuery().Between("at", start, end).Sort(bson.M{"at": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 || events[0]["name"] != "start" || events[1]["name"] != "inside" || events[2]["name"] != "end" {
+		t.Errorf("got %v, want the events inside the window", events)
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	assertFilter(t, CreateQuery().Regex("name", "^a", "i").Build(nil), bson.M{"name": primitive.Regex{Pattern: "^a", Options: "i"}})
+	assertFilter(t, CreateQuery().Contains("name", "a.b").Build(nil), bson.M{"name": primitive.Regex{Pattern: `a\.b`, Options: "i"}})
+}
+
+func TestContainsMatchesLiterallyIgnoringCase(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "files", bson.M{"name": "A.B.txt"}, bson.M{"name": "axb.txt"}, bson.M{"name": "report.pdf"})
+
+	files, err := GetDocumentsTyped[bson.M](database, "files", CreateQuery().Contains("name", "a.b"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0]["name"] != "A.B.txt" {
+		t.Errorf("got %v, want A.B.txt only", files)
+	}
+
+	files, err = GetDocumentsTyped[bson.M](database, "files", CreateQuery().Regex("name", `\.txt$`, ""))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("got %v, want the two text files", files)
+	}
+}
+
+func TestExistsAndTypeFilters(t *testing.T) {
+	assertFilter(t, CreateQuery().Exists("email", false).Type("age", "string").Build(nil), bson.M{
+		"$and": []interface{}{
+			bson.M{"email": bson.M{"$exists": false}},
+			bson.M{"age": bson.M{"$type": "string"}},
+		},
+	})
+}
+
+func TestExistsIsolatesMissingFields(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"users",
+		bson.M{"name": "ann", "email": "ann@example.com", "age": 31},
+		bson.M{"name": "bob", "age": "40"},
+		bson.M{"name": "cid", "email": nil, "age": 22},
+	)
+
+	missing, err := GetDocumentsTyped[bson.M](database, "users", CreateQuery().Exists("email", false))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missing) != 1 || missing[0]["name"] != "bob" {
+		t.Errorf("got %v, want bob only", missing)
+	}
+
+	mistyped, err := GetDocumentsTyped[bson.M](database, "users", CreateQuery().Type("age", "string"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mistyped) != 1 || mistyped[0]["name"] != "bob" {
+		t.Errorf("got %v, want bob only", mistyped)
+	}
+}
+
+// Skips the test when the server rejects a query operator MongoDB supports,
+// some compatible servers lack operators or only support some of their forms.
+func skipIfUnknownOperator(t *testing.T, err error) {
+	t.Helper()
+
+	var serverError mongo.ServerError
+
+	if errors.As(err, &serverError) && serverError.HasErrorCode(2) && strings.Contains(err.Error(), "unknown operator") {
+		t.Skipf("the operator is not supported by the server: %v", err)
+	}
+}
+
+func TestElemMatchNeedsOneElementMatchingEverything(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"sensors",
+		bson.M{"name": "same", "readings": bson.A{bson.M{"type": "temp", "value": 30}}},
+		bson.M{"name": "spread", "readings": bson.A{bson.M{"type": "temp", "value": 10}, bson.M{"type": "humidity", "value": 30}}},
+	)
+
+	conditions := bson.M{"type": "temp", "value": bson.M{"$gte": 25}}
+
+	assertFilter(t, CreateQuery().ElemMatch("readings", conditions).Build(nil), bson.M{"readings": bson.M{"$elemMatch": conditions}})
+
+	sensors, err := GetDocumentsTyped[bson.M](database, "sensors", CreateQuery().ElemMatch("readings", conditions))
+
+	skipIfUnknownOperator(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sensors) != 1 || sensors[0]["name"] != "same" {
+		t.Errorf("got %v, want same only", sensors)
+	}
+
+	// Separate filters may each be satisfied by a different element.
+	spread, err := CountDocuments(database, "sensors", CreateQuery(bson.M{"readings.type": "temp"}, bson.M{"readings.value": bson.M{"$gte": 25}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spread != 2 {
+		t.Errorf("got %d documents, want both without $elemMatch", spread)
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	original := CreateQuery(bson.M{"kind": "post"}).Limit(10).Upsert(false)
+	clone := original.Clone()
+
+	clone.Filter(bson.M{"published": true}).Limit(5).Upsert(true)
+	clone.Query[0]["kind"] = "page"
+
+	assertFilter(t, original.Build(nil), bson.M{"kind": "post"})
+
+	if *original.FindOptions.Limit != 10 || *original.UpdateOptions.Upsert {
+		t.Errorf("got limit %d and upsert %v, want the original options", *original.FindOptions.Limit, *original.UpdateOptions.Upsert)
+	}
+
+	assertFilter(t, clone.Build(nil), bson.M{
+		"$and": []interface{}{bson.M{"kind": "page"}, bson.M{"published": true}},
+	})
+
+	if *clone.FindOptions.Limit != 5 || !*clone.UpdateOptions.Upsert {
+		t.Errorf("got limit %d and upsert %v, want the clone's options", *clone.FindOptions.Limit, *clone.UpdateOptions.Upsert)
+	}
+}
+
+func TestResetClearsFiltersAndOptions(t *testing.T) {
+	query := CreateQuery(bson.M{"kind": "post"}).Limit(10).Upsert(true).ReturnUpdated(true)
+	query.Reset().Filter(bson.M{"kind": "page"})
+
+	assertFilter(t, query.Build(nil), bson.M{"kind": "page"})
+
+	if query.FindOptions != nil || query.UpdateOptions != nil || query.DeleteOptions != nil || query.ReturnDocument != nil {
+		t.Errorf("got %+v, want no options", query)
+	}
+
+	assertFilter(t, query.Reset().Build(nil), bson.M{})
+}
+
+func TestInsertDocumentsTyped(t *testing.T) {
+	database := testDatabase(t)
+	documents := []numbered{{N: 1}, {N: 2}, {N: 3}}
+
+	res, err := InsertDocumentsTyped(database, "items", documents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.InsertedIDs) != 3 {
+		t.Errorf("got %d ids, want 3", len(res.InsertedIDs))
+	}
+
+	stored, err := GetDocumentsTyped[numbered](database, "items", CreateQuery().Sort(bson.M{"n": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 3 || stored[0] != documents[0] || stored[2] != documents[2] {
+		t.Errorf("got %v, want %v", stored, documents)
+	}
+}
+
+// Returned by testValidatedUser when it has no name.
+var errNameRequired = errors.New("name is required")
+
+// Model refusing to be saved without a name.
+type testValidatedUser struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Name string             `bson:"name"`
+}
+
+func (instance *testValidatedUser) GetID() primitive.ObjectID {
+	return instance.ID
+}
+
+func (instance *testValidatedUser) SetID(id primitive.ObjectID) {
+	instance.ID = id
+}
+
+func (instance *testValidatedUser) Validate() error {
+	if instance.Name == "" {
+		return errNameRequired
+	}
+
+	return nil
+}
+
+func TestSaveModelValidates(t *testing.T) {
+	database := testDatabase(t)
+	user := &testValidatedUser{}
+
+	err := SaveModel(user, database, "users")
+
+	if !errors.Is(err, errNameRequired) {
+		t.Errorf("insert: got %v, want the validation error", err)
+	}
+
+	if user.ID != primitive.NilObjectID {
+		t.Error("the invalid model was given an id")
+	}
+
+	user.Name = "ann"
+
+	if err = SaveModel(user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	user.Name = ""
+	err = SaveModel(user, database, "users")
+
+	if !errors.Is(err, errNameRequired) {
+		t.Errorf("update: got %v, want the validation error", err)
+	}
+
+	if stored := storedDocument(t, database, "users", user.ID); stored["name"] != "ann" {
+		t.Errorf("got %v, want the invalid update skipped", stored)
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want 1", count)
+	}
+}
+
+// Model protected against lost updates.
+type testVersionedUser struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Name    string             `bson:"name"`
+	Version int64              `bson:"version"`
+}
+
+func (instance *testVersionedUser) GetID() primitive.ObjectID {
+	return instance.ID
+}
+
+func (instance *testVersionedUser) SetID(id primitive.ObjectID) {
+	instance.ID = id
+}
+
+func (instance *testVersionedUser) GetVersion() int64 {
+	return instance.Version
+}
+
+func (instance *testVersionedUser) SetVersion(version int64) {
+	instance.Version = version
+}
+
+func TestSaveModelRejectsStaleVersions(t *testing.T) {
+	database := testDatabase(t)
+	user := &testVersionedUser{Name: "ann"}
+
+	if err := SaveModel(user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Version != 1 {
+		t.Errorf("got version %d after the insert, want 1", user.Version)
+	}
+
+	// Another writer read the same document and saves first.
+	concurrent := *user
+	concurrent.Name = "anne"
+
+	if err := SaveModel(&concurrent, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if concurrent.Version != 2 {
+		t.Errorf("got version %d after the update, want 2", concurrent.Version)
+	}
+
+	user.Name = "annie"
+	err := SaveModel(user, database, "users")
+
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Errorf("got %v, want ErrStaleVersion", err)
+	}
+
+	if user.Version != 1 {
+		t.Errorf("got version %d after the stale write, want it restored to 1", user.Version)
+	}
+
+	stored := storedDocument(t, database, "users", user.ID)
+
+	if stored["name"] != "anne" || stored["version"] != int64(2) {
+		t.Errorf("got %v, want the concurrent write kept", stored)
+	}
+}
+
+// Model recording which of its lifecycle hooks ran, in order.
+type testHookedUser struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Name string             `bson:"name"`
+
+	calls     []string
+	hookError error
+}
+
+func (instance *testHookedUser) GetID() primitive.ObjectID {
+	return instance.ID
+}
+
+func (instance *testHookedUser) SetID(id primitive.ObjectID) {
+	instance.ID = id
+}
+
+func (instance *testHookedUser) BeforeSave() error {
+	instance.calls = append(instance.calls, "BeforeSave")
+
+	return instance.hookError
+}
+
+func (instance *testHookedUser) AfterSave() error {
+	instance.calls = append(instance.calls, "AfterSave")
+
+	return nil
+}
+
+func (instance *testHookedUser) BeforeDelete() error {
+	instance.calls = append(instance.calls, "BeforeDelete")
+
+	return instance.hookError
+}
+
+func (instance *testHookedUser) AfterDelete() error {
+	instance.calls = append(instance.calls, "AfterDelete")
+
+	return nil
+}
+
+// Checks the hooks ran in the expected order, then forgets them.
+func assertCalls(t *testing.T, user *testHookedUser, want ...string) {
+	t.Helper()
+
+	if len(user.calls) != len(want) {
+		t.Errorf("got hooks %v, want %v", user.calls, want)
+	} else {
+		for i_ := range want {
+			if user.calls[i_] != want[i_] {
+				t.Errorf("got hooks %v, want %v", user.calls, want)
+
+				break
+			}
+		}
+	}
+
+	user.calls = nil
+}
+
+func TestSaveAndDeleteHooksRunInOrder(t *testing.T) {
+	database := testDatabase(t)
+	user := &testHookedUser{Name: "ann"}
+
+	if err := SaveModel(user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, user, "BeforeSave", "AfterSave")
+
+	if err := DeleteModel(user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertCalls(t, user, "BeforeDelete", "AfterDelete")
+}
+
+func TestBeforeHooksAbort(t *testing.T) {
+	database := testDatabase(t)
+	failure := errors.New("rejected")
+	user := &testHookedUser{Name: "ann", hookError: failure}
+
+	err := SaveModel(user, database, "users")
+
+	if !errors.Is(err, failure) {
+		t.Errorf("got %v, want the BeforeSave error", err)
+	}
+
+	assertCalls(t, user, "BeforeSave")
+
+	if user.ID != primitive.NilObjectID {
+		t.Error("the model was written")
+	}
+
+	user.hookError = nil
+
+	if err = SaveModel(user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	user.hookError = failure
+	user.calls = nil
+	err = DeleteModel(user, database, "users")
+
+	if !errors.Is(err, failure) {
+		t.Errorf("got %v, want the BeforeDelete error", err)
+	}
+
+	assertCalls(t, user, "BeforeDelete")
+
+	count, err := CountDocuments(database, "users", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want the delete aborted", count)
+	}
+}
+
+func TestSaveModelsMixedBatch(t *testing.T) {
+	database := testDatabase(t)
+	existing := &testVersionedUser{Name: "ann"}
+
+	if err := SaveModel(existing, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	existing.Name = "anne"
+	created := []*testVersionedUser{{Name: "bob"}, {Name: "cid"}}
+
+	err := SaveModels([]BaseModel{created[0], existing, created[1]}, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range created {
+		if user.ID == primitive.NilObjectID || user.Version != 1 {
+			t.Errorf("got %+v, want an id and version 1", user)
+		}
+
+		if stored := storedDocument(t, database, "users", user.ID); stored["name"] != user.Name {
+			t.Errorf("got %v, want %s stored", stored, user.Name)
+		}
+	}
+
+	if existing.Version != 2 {
+		t.Errorf("got version %d, want 2", existing.Version)
+	}
+
+	if stored := storedDocument(t, database, "users", existing.ID); stored["name"] != "anne" || stored["version"] != int64(2) {
+		t.Errorf("got %v, want the update stored", stored)
+	}
+}
+
+func TestSaveModelsRestoresOnlyTheStaleVersions(t *testing.T) {
+	database := testDatabase(t)
+	fresh, stale := &testVersionedUser{Name: "ann"}, &testVersionedUser{Name: "bob"}
+
+	if err := SaveModels([]BaseModel{fresh, stale}, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := UpdateDocument(database, "users", CreateQuery(bson.M{"_id": stale.ID}), bson.M{"$set": bson.M{"version": int64(5)}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fresh.Name, stale.Name = "anne", "bobby"
+	err = SaveModels([]BaseModel{fresh, stale}, database, "users")
+
+	if !errors.Is(err, ErrStaleVersion) {
+		t.Fatalf("got %v, want ErrStaleVersion", err)
+	}
+
+	if fresh.Version != 2 || stale.Version != 1 {
+		t.Errorf("got versions %d and %d, want the written one kept at 2 and the stale one restored to 1", fresh.Version, stale.Version)
+	}
+
+	if stored := storedDocument(t, database, "users", fresh.ID); stored["name"] != "anne" || stored["version"] != int64(2) {
+		t.Errorf("got %v, want the fresh model written", stored)
+	}
+
+	fresh.Name = "annie"
+
+	if err := SaveModel(fresh, database, "users"); err != nil {
+		t.Errorf("got %v saving the written model again, want its version to match", err)
+	}
+}
+
+func TestSaveModelsValidatesBeforeVersioning(t *testing.T) {
+	database := testDatabase(t)
+	existing := &testVersionedUser{Name: "ann"}
+
+	if err := SaveModel(existing, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	created := &testVersionedUser{Name: "bob"}
+	err := SaveModels([]BaseModel{existing, created, &testValidatedUser{}}, database, "users")
+
+	if !errors.Is(err, errNameRequired) {
+		t.Fatalf("got %v, want the validation error", err)
+	}
+
+	if existing.Version != 1 || created.Version != 0 {
+		t.Errorf("got versions %d and %d, want the batch untouched", existing.Version, created.Version)
+	}
+}
+
+func TestSaveModelsRestoresVersionsWhenTheInsertFails(t *testing.T) {
+	database := testDatabase(t)
+
+	if err := CreateUniqueIndexes(database, "users", IndexField{Field: "name", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := &testVersionedUser{Name: "ann"}
+
+	if err := SaveModel(existing, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	existing.Name = "anne"
+	duplicate := &testVersionedUser{Name: "ann"}
+	err := SaveModels([]BaseModel{existing, duplicate}, database, "users")
+
+	if !IsDuplicateKeyError(err) {
+		t.Fatalf("got %v, want the duplicate key error", err)
+	}
+
+	if existing.Version != 1 || duplicate.Version != 0 {
+		t.Errorf("got versions %d and %d, want both restored", existing.Version, duplicate.Version)
+	}
+
+	if err := SaveModel(existing, database, "users"); err != nil {
+		t.Errorf("got %v saving the restored model, want its version to match", err)
+	}
+}
+
+func TestSaveModelsKeepsTheIDsOfTheInsertedPrefix(t *testing.T) {
+	database := testDatabase(t)
+
+	if err := CreateUniqueIndexes(database, "users", IndexField{Field: "name", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	seedDocuments(t, database, "users", bson.M{"name": "bob"})
+
+	ann := &testVersionedUser{Name: "ann"}
+	bob := &testVersionedUser{Name: "bob"}
+	cid := &testVersionedUser{Name: "cid"}
+	err := SaveModels([]BaseModel{ann, bob, cid}, database, "users")
+
+	if !IsDuplicateKeyError(err) {
+		t.Fatalf("got %v, want the duplicate key error", err)
+	}
+
+	if ann.ID == primitive.NilObjectID || ann.Version != 1 {
+		t.Errorf("got %+v, want the inserted model to keep its _id and version", ann)
+	}
+
+	for _, user := range []*testVersionedUser{bob, cid} {
+		if user.ID != primitive.NilObjectID || user.Version != 0 {
+			t.Errorf("got %+v, want the unwritten model left new", user)
+		}
+	}
+
+	bob.Name = "bobby"
+
+	if err := SaveModels([]BaseModel{ann, bob, cid}, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery(bson.M{}))
+
+	if err != nil || count != 4 {
+		t.Errorf("got %d documents and %v, want the retry to store each model once", count, err)
+	}
+}
+
+func TestRepositoryCRUD(t *testing.T) {
+	database := testDatabase(t)
+	users := CreateRepository[testValidatedUser](database, "users")
+	ann := &testValidatedUser{Name: "ann"}
+
+	for _, user := range []*testValidatedUser{ann, {Name: "bob"}} {
+		if err := users.Save(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := users.FindByID(ann.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found == nil || found.Name != "ann" {
+		t.Errorf("FindByID: got %v, want ann", found)
+	}
+
+	ann.Name = "anne"
+
+	if err = users.Save(ann); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = users.FindOne(CreateQuery(bson.M{"name": "anne"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found == nil || found.ID != ann.ID {
+		t.Errorf("FindOne: got %v, want the updated ann", found)
+	}
+
+	all, err := users.Find(CreateQuery().Sort(bson.M{"name": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 2 || all[0].Name != "anne" || all[1].Name != "bob" {
+		t.Errorf("Find: got %v, want anne and bob", all)
+	}
+
+	if err = users.Delete(ann); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := users.Count(CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("Count: got %d, want 1", count)
+	}
+
+	missing, err := users.FindByID(primitive.NewObjectID())
+
+	if missing != nil || err != nil {
+		t.Errorf("FindByID: got %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestGetDocumentByID(t *testing.T) {
+	database := testDatabase(t)
+	id := primitive.NewObjectID()
+	seedDocuments(t, database, "users", bson.M{"_id": id, "name": "ann"})
+
+	found, err := GetDocumentByID[testValidatedUser](database, "users", id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found == nil || found.Name != "ann" {
+		t.Errorf("got %v, want ann", found)
+	}
+
+	found, err = GetDocumentByHexID[testValidatedUser](database, "users", id.Hex())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found == nil || found.ID != id {
+		t.Errorf("hex: got %v, want ann", found)
+	}
+
+	missing, err := GetDocumentByID[testValidatedUser](database, "users", primitive.NewObjectID())
+
+	if missing != nil || err != nil {
+		t.Errorf("not found: got %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestGetDocumentByHexIDRejectsMalformedIDs(t *testing.T) {
+	found, err := GetDocumentByHexID[testValidatedUser](unreachableDatabase(t), "users", "not-an-id")
+
+	if found != nil || err != primitive.ErrInvalidHex {
+		t.Errorf("got %v, %v, want primitive.ErrInvalidHex", found, err)
+	}
+}
+
+func TestDeleteDocumentByID(t *testing.T) {
+	database := testDatabase(t)
+	first, second := primitive.NewObjectID(), primitive.NewObjectID()
+	seedDocuments(t, database, "users", bson.M{"_id": first}, bson.M{"_id": second})
+
+	res, err := DeleteDocumentByID(database, "users", first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 1 {
+		t.Errorf("got %d deleted, want 1", res.DeletedCount)
+	}
+
+	res, err = DeleteDocumentByID(database, "users", first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 0 {
+		t.Errorf("no match: got %d deleted, want 0", res.DeletedCount)
+	}
+
+	res, err = DeleteDocumentByHexID(database, "users", second.Hex())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 1 {
+		t.Errorf("hex: got %d deleted, want 1", res.DeletedCount)
+	}
+
+	_, err = DeleteDocumentByHexID(database, "users", "zz")
+
+	if err != primitive.ErrInvalidHex {
+		t.Errorf("got %v, want primitive.ErrInvalidHex", err)
+	}
+}
+
+func TestDocumentExists(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 3)
+
+	for query, want := range map[*QuerySet]bool{
+		CreateQuery(bson.M{"n": 2}):                true,
+		CreateQuery(bson.M{"n": bson.M{"$gt": 0}}): true,
+		CreateQuery(bson.M{"n": 4}):                false,
+	} {
+		exists, err := DocumentExists(database, "items", query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != want {
+			t.Errorf("%v: got %v, want %v", query.Build(nil), exists, want)
+		}
+	}
+}
+
+// Checks for documents matching a filter most of the collection satisfies.
+func benchmarkExistence(b *testing.B, exists func(*mongo.Database, *QuerySet) error) {
+	database := testDatabase(b)
+	seedNumbered(b, database, "items", 20000)
+	b.ResetTimer()
+
+	for i_ := 0; i_ < b.N; i_++ {
+		if err := exists(database, CreateQuery(bson.M{"n": bson.M{"$gt": 10}})); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDocumentExists(b *testing.B) {
+	benchmarkExistence(b, func(database *mongo.Database, query *QuerySet) error {
+		_, err := DocumentExists(database, "items", query)
+
+		return err
+	})
+}
+
+func BenchmarkCountDocumentsForExistence(b *testing.B) {
+	benchmarkExistence(b, func(database *mongo.Database, query *QuerySet) error {
+		_, err := CountDocuments(database, "items", query)
+
+		return err
+	})
+}
+
+func TestEstimatedDocumentCount(t *testing.T) {
+	database := testDatabase(t)
+
+	count, err := EstimatedDocumentCount(database, "items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Errorf("got %d for a missing collection, want 0", count)
+	}
+
+	seedNumbered(t, database, "items", 25)
+	count, err = EstimatedDocumentCount(database, "items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 25 {
+		t.Errorf("got %d, want 25", count)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(mongo.ErrNoDocuments) || !IsNotFound(fmt.Errorf("loading: %w", ErrNotFound)) {
+		t.Error("the no documents error was not recognized")
+	}
+
+	if IsNotFound(nil) || IsNotFound(errors.New("other")) {
+		t.Error("another error was reported as not found")
+	}
+}
+
+func TestSingleResultHelpersReportNoDocumentConsistently(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"n": 1})
+	query := CreateQuery(bson.M{"n": 2})
+
+	for name, find := range map[string]func() (*mongo.SingleResult, error){
+		"GetDocument": func() (*mongo.SingleResult, error) {
+			return GetDocument(database, "items", query)
+		},
+		"FindAndUpdateDocument": func() (*mongo.SingleResult, error) {
+			return FindAndUpdateDocument(database, "items", query, bson.M{"$set": bson.M{"seen": true}})
+		},
+		"FindAndDeleteDocument": func() (*mongo.SingleResult, error) {
+			return FindAndDeleteDocument(database, "items", query)
+		},
+	} {
+		res, err := find()
+
+		if res != nil || err != nil {
+			t.Errorf("%s: got %v, %v, want nil, nil", name, res, err)
+		}
+	}
+
+	res, err := GetDocument(database, "items", CreateQuery(bson.M{"n": 1}))
+
+	if res == nil || err != nil {
+		t.Errorf("got %v, %v, want the document", res, err)
+	}
+}
+
+func TestErrorsNameTheOperationAndCollection(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"_id": 1})
+
+	_, err := InsertDocument(database, "items", bson.M{"_id": 1})
+
+	if err == nil {
+		t.Fatal("got no error, want a duplicate key error")
+	}
+
+	if message := err.Error(); !strings.Contains(message, `InsertOne on "items"`) {
+		t.Errorf("got %q, want the operation and collection named", message)
+	}
+
+	var writeException mongo.WriteException
+
+	if !errors.As(errors.Unwrap(err), &writeException) {
+		t.Errorf("got %T once unwrapped, want the driver's mongo.WriteException", errors.Unwrap(err))
+	}
+
+	_, err = UpdateDocument(database, "items", CreateQuery(), bson.M{"$bogus": bson.M{"n": 1}})
+
+	if err == nil || !strings.Contains(err.Error(), `UpdateOne on "items"`) {
+		t.Errorf("got %v, want the update named", err)
+	}
+
+	var serverError mongo.ServerError
+
+	if !errors.As(err, &serverError) {
+		t.Errorf("got %v, want a mongo.ServerError behind it", err)
+	}
+}
+
+func TestWrapErrorKeepsNoError(t *testing.T) {
+	if err := wrapError("Find", "items", nil); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
+
+func TestIsDuplicateKeyError(t *testing.T) {
+	database := testDatabase(t)
+
+	if err := CreateUniqueIndexes(database, "users", IndexField{Field: "email", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := InsertDocument(database, "users", bson.M{"email": "ann@example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocument(database, "users", bson.M{"email": "ann@example.com"})
+
+	if !IsDuplicateKeyError(err) {
+		t.Errorf("got %v, want a duplicate key error", err)
+	}
+
+	_, err = InsertDocuments(database, "users", []interface{}{bson.M{"email": "bob@example.com"}, bson.M{"email": "bob@example.com"}})
+
+	if !IsDuplicateKeyError(err) {
+		t.Errorf("InsertMany: got %v, want a duplicate key error", err)
+	}
+
+	_, err = UpdateDocument(database, "users", CreateQuery(), bson.M{"$bogus": bson.M{"n": 1}})
+
+	if err == nil || IsDuplicateKeyError(err) {
+		t.Errorf("got %v, want another error", err)
+	}
+
+	if IsDuplicateKeyError(nil) || IsDuplicateKeyError(errors.New("E11000 lookalike")) {
+		t.Error("a non driver error was reported as a duplicate key error")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("other"), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{mongo.CommandError{Code: 11600}, true},
+		{mongo.CommandError{Code: 10107}, true},
+		{mongo.CommandError{Code: 11000}, false},
+		{mongo.CommandError{Code: 2, Labels: []string{"RetryableWriteError"}}, true},
+	} {
+		if got := IsTransient(test.err); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestWithRetryRetriesTransientErrors(t *testing.T) {
+	calls := 0
+	err := WithRetry(5, time.Millisecond, func() error {
+		calls++
+
+		if calls < 3 {
+			return mongo.CommandError{Code: 11602}
+		}
+
+		return nil
+	})
+
+	if err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want success after 3", err, calls)
+	}
+}
+
+func TestWithRetryStopsAtOtherErrors(t *testing.T) {
+	failure := errors.New("invalid")
+	calls := 0
+	err := WithRetry(5, time.Millisecond, func() error {
+		calls++
+
+		return failure
+	})
+
+	if err != failure || calls != 1 {
+		t.Errorf("got %v after %d calls, want the error after 1", err, calls)
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	calls := 0
+	err := WithRetry(3, time.Millisecond, func() error {
+		calls++
+
+		return mongo.CommandError{Code: 91}
+	})
+
+	if !IsTransient(err) || calls != 3 {
+		t.Errorf("got %v after %d calls, want the transient error after 3", err, calls)
+	}
+}
+
+func TestWithRetryRejectsNonPositiveAttempts(t *testing.T) {
+	for _, attempts := range []int{0, -1} {
+		calls := 0
+		err := WithRetry(attempts, time.Millisecond, func() error {
+			calls++
+
+			return nil
+		})
+
+		if !errors.Is(err, ErrInvalidAttempts) || calls != 0 {
+			t.Errorf("%d attempts: got %v after %d calls, want ErrInvalidAttempts and no call", attempts, err, calls)
+		}
+	}
+}
+
+func TestWithRetryCtxHonorsCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := WithRetryCtx(ctx, 5, time.Hour, func() error {
+		calls++
+		cancel()
+
+		return mongo.CommandError{Code: 91}
+	})
+
+	if calls != 1 || !IsTransient(err) {
+		t.Errorf("got %v after %d calls, want no retry once cancelled", err, calls)
+	}
+}
+
+func TestStreamDocuments(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 5)
+
+	total := 0
+	err := StreamDocuments(database, "items", CreateQuery().Sort(bson.M{"n": 1}), func(item numbered) error {
+		total += item.N
+
+		return nil
+	})
+
+	if err != nil || total != 15 {
+		t.Errorf("got %d, %v, want every document streamed", total, err)
+	}
+}
+
+func TestStreamStopsEarlyAndClosesTheCursor(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 5)
+	stop := errors.New("stop")
+
+	cursor, err := GetDocuments(database, "items", CreateQuery().Sort(bson.M{"n": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []int
+	err = StreamCursor(cursor, func(item numbered) error {
+		seen = append(seen, item.N)
+
+		if item.N == 2 {
+			return stop
+		}
+
+		return nil
+	})
+
+	if err != stop || len(seen) != 2 {
+		t.Errorf("got %v after %v, want to stop at 2", err, seen)
+	}
+
+	if cursor.Next(context.Background()) {
+		t.Error("the cursor was left open")
+	}
+
+	calls := 0
+	err = StreamDocuments(database, "items", CreateQuery(), func(item bson.M) error {
+		calls++
+
+		return stop
+	})
+
+	if err != stop || calls != 1 {
+		t.Errorf("got %v after %d calls, want to stop after 1", err, calls)
+	}
+}
+
+func TestBatchSizeSetsTheFindOption(t *testing.T) {
+	query := CreateQuery().BatchSize(2)
+
+	if query.FindOptions.BatchSize == nil || *query.FindOptions.BatchSize != 2 {
+		t.Errorf("got %v, want a batch size of 2", query.FindOptions.BatchSize)
+	}
+}
+
+func TestBatchSizeIsHonoredByTheReads(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 5)
+
+	cursor, err := GetDocuments(database, "items", CreateQuery().BatchSize(2))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining := cursor.RemainingBatchLength(); remaining != 2 {
+		t.Errorf("got a first batch of %d documents, want 2", remaining)
+	}
+
+	count := 0
+	err = StreamCursor(cursor, func(item numbered) error {
+		count++
+
+		return nil
+	})
+
+	if err != nil || count != 5 {
+		t.Errorf("got %d, %v, want every document across the batches", count, err)
+	}
+}
+
+func TestCollationAppliesToEveryOperation(t *testing.T) {
+	query := CreateQuery().CaseInsensitive("en")
+	want := options.Collation{Locale: "en", Strength: 2}
+
+	for name, collation := range map[string]*options.Collation{
+		"find":   query.FindOptions.Collation,
+		"update": query.UpdateOptions.Collation,
+		"delete": query.DeleteOptions.Collation,
+		"count":  query.CountOptions().Collation,
+	} {
+		if collation == nil || *collation != want {
+			t.Errorf("%s: got %v, want %v", name, collation, want)
+		}
+	}
+}
+
+func TestCaseInsensitiveSortOrder(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "bob"}, bson.M{"name": "Cid"}, bson.M{"name": "ann"})
+
+	names := func(query *QuerySet) string {
+		users, err := GetDocumentsTyped[bson.M](database, "users", query.Sort(bson.M{"name": 1}))
+		skipIfNotImplemented(t, err)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sorted := make([]string, len(users))
+
+		for i_, user := range users {
+			sorted[i_] = user["name"].(string)
+		}
+
+		return strings.Join(sorted, " ")
+	}
+
+	// Upper case letters sort first by default.
+	if sorted := names(CreateQuery()); sorted != "Cid ann bob" {
+		t.Errorf("default: got %s, want Cid ann bob", sorted)
+	}
+
+	if sorted := names(CreateQuery().CaseInsensitive("en")); sorted != "ann bob Cid" {
+		t.Errorf("case insensitive: got %s, want ann bob Cid", sorted)
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery(bson.M{"name": "CID"}).CaseInsensitive("en"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want the case insensitive match", count)
+	}
+}
+
+func TestHintAppliesToEveryOperation(t *testing.T) {
+	query := CreateQuery().Hint("name_1")
+
+	for name, hint := range map[string]interface{}{
+		"find":   query.FindOptions.Hint,
+		"update": query.UpdateOptions.Hint,
+		"delete": query.DeleteOptions.Hint,
+		"count":  query.CountOptions().Hint,
+		"one":    query.FindOneOptions().Hint,
+	} {
+		if hint != "name_1" {
+			t.Errorf("%s: got %v, want name_1", name, hint)
+		}
+	}
+}
+
+// Returns a fresh database like testDatabase(), along with the commands sent to the server by name.
+func monitoredDatabase(t *testing.T) (*mongo.Database, func(name string) []bson.Raw) {
+	t.Helper()
+
+	url := os.Getenv("MONGODB_TEST_URI")
+
+	if url == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	var lock sync.Mutex
+	commands := map[string][]bson.Raw{}
+	monitor := &event.CommandMonitor{
+		Started: func(ctx context.Context, started *event.CommandStartedEvent) {
+			lock.Lock()
+			commands[started.CommandName] = append(commands[started.CommandName], started.Command)
+			lock.Unlock()
+		},
+	}
+
+	database, err := GetDatabaseWithOptions(
+		url,
+		fmt.Sprintf("mongodbutilities_test_%d", time.Now().UnixNano()),
+		options.Client().SetMonitor(monitor),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		defer cancel()
+
+		_ = database.Drop(ctx)
+		_ = database.Client().Disconnect(ctx)
+	})
+
+	return database, func(name string) []bson.Raw {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return commands[name]
+	}
+}
+
+func TestHintIsSentToTheServer(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann"})
+
+	if err := CreateIndexes(database, "users", IndexField{Field: "name", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	query := CreateQuery(bson.M{"name": "ann"}).Hint("name_1")
+
+	_, err := GetDocumentsTyped[bson.M](database, "users", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CountDocuments(database, "users", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UpdateDocument(database, "users", query, bson.M{"$set": bson.M{"n": 1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	find := commands("find")
+
+	if len(find) != 1 || find[0].Lookup("hint").StringValue() != "name_1" {
+		t.Errorf("got find commands %v, want the hint", find)
+	}
+
+	// The count runs as an aggregation, the hint is one of its options.
+	aggregate := commands("aggregate")
+
+	if len(aggregate) != 1 || aggregate[0].Lookup("hint").StringValue() != "name_1" {
+		t.Errorf("got aggregate commands %v, want the hint", aggregate)
+	}
+
+	update := commands("update")
+
+	if len(update) != 1 || update[0].Lookup("updates", "0", "hint").StringValue() != "name_1" {
+		t.Errorf("got update commands %v, want the hint", update)
+	}
+}
+
+func TestMaxTimeSetsTheFindAndCountOptions(t *testing.T) {
+	query := CreateQuery().MaxTime(250 * time.Millisecond)
+
+	if query.FindOptions.MaxTime == nil || *query.FindOptions.MaxTime != 250*time.Millisecond {
+		t.Errorf("find: got %v, want 250ms", query.FindOptions.MaxTime)
+	}
+
+	if maxTime := query.CountOptions().MaxTime; maxTime == nil || *maxTime != 250*time.Millisecond {
+		t.Errorf("count: got %v, want 250ms", maxTime)
+	}
+
+	if maxTime := query.FindOneOptions().MaxTime; maxTime == nil || *maxTime != 250*time.Millisecond {
+		t.Errorf("find one: got %v, want 250ms", maxTime)
+	}
+}
+
+// Converts a numeric statistic, whose BSON type depends on the server, to an int64.
+func statistic(t *testing.T, stats bson.M, name string) int64 {
+	t.Helper()
+
+	switch value := stats[name].(type) {
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	}
+
+	t.Fatalf("got %s %v(%T), want a number", name, stats[name], stats[name])
+
+	return 0
+}
+
+func TestGetStats(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 4)
+	seedNumbered(t, database, "others", 2)
+
+	collectionStats, err := GetCollectionStats(database, "items")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := statistic(t, collectionStats, "count"); count != 4 {
+		t.Errorf("got a count of %d, want 4", count)
+	}
+
+	databaseStats, err := GetDatabaseStats(database)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if objects := statistic(t, databaseStats, "objects"); objects != 6 {
+		t.Errorf("got %d objects, want 6", objects)
+	}
+
+	if collections := statistic(t, databaseStats, "collections"); collections != 2 {
+		t.Errorf("got %d collections, want 2", collections)
+	}
+}
+
+func TestGetStatsErrorsNameTheCommand(t *testing.T) {
+	database := unreachableDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel()
+
+	for command, call := range map[string]func() error{
+		`collStats on "items"`: func() error {
+			_, err := GetCollectionStatsCtx(ctx, database, "items")
+			return err
+		},
+		`dbStats on "mongodbutilities_test"`: func() error {
+			_, err := GetDatabaseStatsCtx(ctx, database)
+			return err
+		},
+	} {
+		err := call()
+
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), command) {
+			t.Errorf("got %v, want the deadline error wrapped with %s", err, command)
+		}
+	}
+}
+
+func TestUpsertManyMergesByKey(t *testing.T) {
+	database := testDatabase(t)
+	batch := []bson.M{
+		{"external_id": "a", "n": 1},
+		{"external_id": "b", "n": 2},
+	}
+
+	res, err := UpsertMany(database, "imports", "external_id", batch)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UpsertedCount != 2 {
+		t.Errorf("first run: got %+v, want 2 upserts", res)
+	}
+
+	batch[0]["n"] = 10
+	res, err = UpsertMany(database, "imports", "external_id", append(batch, bson.M{"external_id": "c", "n": 3}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UpsertedCount != 1 || res.MatchedCount != 2 || res.ModifiedCount != 1 {
+		t.Errorf("second run: got %+v, want 1 upsert and 1 modified", res)
+	}
+
+	imported, err := GetDocumentsTyped[bson.M](database, "imports", CreateQuery().Sort(bson.M{"external_id": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(imported) != 3 || imported[0]["n"] != int32(10) {
+		t.Errorf("got %v, want 3 documents with a updated", imported)
+	}
+}
+
+func TestUpsertManyEdgeCases(t *testing.T) {
+	database := unreachableDatabase(t)
+
+	res, err := UpsertMany(database, "imports", "external_id", nil)
+
+	if err != nil || res == nil {
+		t.Errorf("got %v, %v, want an empty result", res, err)
+	}
+
+	_, err = UpsertMany(database, "imports", "external_id", []bson.M{{"n": 1}})
+
+	if !errors.Is(err, ErrMissingKey) {
+		t.Errorf("got %v, want ErrMissingKey", err)
+	}
+}
+
+func TestIncrementAndSetFields(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "counters", bson.M{"name": "hits", "n": 5})
+	query := CreateQuery(bson.M{"name": "hits"})
+
+	read := func() bson.M {
+		counter, err := GetDocumentTyped[bson.M](database, "counters", query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return *counter
+	}
+
+	if _, err := IncrementField(database, "counters", query, "n", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := read()["n"]; n != int64(8) && n != int32(8) {
+		t.Errorf("got %v, want 8 after the increment", n)
+	}
+
+	if _, err := IncrementField(database, "counters", query, "n", -10); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := read()["n"]; n != int64(-2) && n != int32(-2) {
+		t.Errorf("got %v, want -2 after the decrement", n)
+	}
+
+	res, err := SetFields(database, "counters", query, bson.M{"label": "page hits", "n": 0})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counter := read(); res.ModifiedCount != 1 || counter["label"] != "page hits" || counter["n"] != int32(0) {
+		t.Errorf("got %v, want the fields set", counter)
+	}
+}
+
+func TestArrayUpdateHelpers(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "posts", bson.M{"name": "a", "tags": bson.A{"go"}})
+	query := CreateQuery(bson.M{"name": "a"})
+
+	tags := func() []string {
+		post, err := GetDocumentTyped[struct {
+			Tags []string `bson:"tags"`
+		}](database, "posts", query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return post.Tags
+	}
+
+	assertTags := func(step string, want ...string) {
+		t.Helper()
+
+		got := tags()
+
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %v, want %v", step, got, want)
+		}
+
+		for i_ := range want {
+			if got[i_] != want[i_] {
+				t.Fatalf("%s: got %v, want %v", step, got, want)
+			}
+		}
+	}
+
+	if _, err := PushToArray(database, "posts", query, "tags", "db", "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTags("push", "go", "db", "go")
+
+	if _, err := AddToSet(database, "posts", query, "tags", "go", "mongo"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTags("addToSet", "go", "db", "go", "mongo")
+
+	if _, err := PullFromArray(database, "posts", query, "tags", "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTags("pull", "db", "mongo")
+
+	if _, err := PushToArray(database, "posts", query, "tags"); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTags("push nothing", "db", "mongo")
+}
+
+func TestWatchCollectionReportsInserts(t *testing.T) {
+	database := testDatabase(t)
+	requireReplicaSet(t, database)
+	createCollections(t, database, "events")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+	defer cancel()
+
+	stop := errors.New("stop")
+	received := make(chan bson.M, 1)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- WatchCollectionCtx(ctx, database, "events", nil, nil, func(event bson.M) error {
+			received <- event
+
+			return stop
+		})
+	}()
+
+	// The stream only reports changes made after it was opened, keep inserting until one is seen.
+	ticker := time.NewTicker(100 * time.Millisecond)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-received:
+			if event["operationType"] != "insert" {
+				t.Errorf("got %v, want an insert event", event)
+			}
+
+			if err := <-done; err != stop {
+				t.Errorf("got %v, want the callback's error", err)
+			}
+
+			return
+		case err := <-done:
+			t.Fatalf("the stream ended without an event: %v", err)
+		case <-ticker.C:
+			if _, err := InsertDocument(database, "events", bson.M{"n": 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestWatchCollectionStopsWithTheContext(t *testing.T) {
+	database := testDatabase(t)
+	requireReplicaSet(t, database)
+	createCollections(t, database, "events")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+
+	defer cancel()
+
+	err := WatchCollectionCtx(ctx, database, "events", nil, nil, func(event bson.M) error {
+		return nil
+	})
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestGroupCountAndSum(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"orders",
+		bson.M{"category": "books", "total": 10, "paid": true},
+		bson.M{"category": "books", "total": 5.5, "paid": true},
+		bson.M{"category": "games", "total": 20, "paid": true},
+		bson.M{"category": "games", "total": 99, "paid": false},
+		bson.M{"total": 1, "paid": true},
+	)
+	paid := CreateQuery(bson.M{"paid": true})
+
+	counts, err := GroupCount(database, "orders", "category", paid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) != 3 || counts["books"] != 2 || counts["games"] != 1 || counts["<nil>"] != 1 {
+		t.Errorf("got %v, want books 2, games 1 and <nil> 1", counts)
+	}
+
+	sums, err := GroupSum(database, "orders", "category", "total", paid)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sums) != 3 || sums["books"] != 15.5 || sums["games"] != 20 {
+		t.Errorf("got %v, want books 15.5 and games 20", sums)
+	}
+}
+
+func TestExcludeFieldsBuildsAnExclusionProjection(t *testing.T) {
+	query := CreateQuery().ExcludeFields("password_hash").ExcludeFields("token")
+
+	assertFilter(t, query.FindOptions.Projection, bson.M{"password_hash": 0, "token": 0})
+
+	if query.Err != nil {
+		t.Errorf("got %v, want no error", query.Err)
+	}
+
+	// _id is the one field whose exclusion combines with included fields.
+	if query = CreateQuery().Fields("name").ExcludeFields("_id"); query.Err != nil {
+		t.Errorf("got %v, want _id excluded along with included fields", query.Err)
+	}
+
+	if query = CreateQuery().Fields("name").ExcludeFields("token"); !errors.Is(query.Err, ErrMixedProjection) {
+		t.Errorf("got %v, want ErrMixedProjection", query.Err)
+	}
+
+	if query.Reset().Err != nil {
+		t.Error("Reset kept the error")
+	}
+}
+
+func TestProjectFieldsKeepsTheExistingProjection(t *testing.T) {
+	query := CreateQuery().Project(bson.M{"name": 1}).Fields("age")
+
+	assertFilter(t, query.FindOptions.Projection, bson.M{"name": 1, "age": 1})
+
+	query = CreateQuery().SortByTextScore().Fields("title")
+
+	if query.Err != nil {
+		t.Errorf("got %v, want the text score combined with included fields", query.Err)
+	}
+
+	assertFilter(t, query.FindOptions.Projection, bson.M{"score": bson.M{"$meta": "textScore"}, "title": 1})
+
+	query = CreateQuery().Project(bson.D{{Key: "comments", Value: bson.M{"$slice": 5}}}).ExcludeFields("token")
+
+	assertFilter(t, query.FindOptions.Projection, bson.M{"comments": bson.M{"$slice": 5}, "token": 0})
+
+	if query = CreateQuery().Project(bson.M{"name": 1}).ExcludeFields("token"); !errors.Is(query.Err, ErrMixedProjection) {
+		t.Errorf("got %v, want ErrMixedProjection", query.Err)
+	}
+}
+
+func TestExcludedFieldsAreAbsent(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann", "password_hash": "x", "token": "y"})
+
+	user, err := GetDocumentTyped[bson.M](database, "users", CreateQuery().ExcludeFields("password_hash", "token"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := (*user)["password_hash"]; found || (*user)["name"] != "ann" {
+		t.Errorf("got %v, want password_hash excluded", *user)
+	}
+
+	if _, found := (*user)["token"]; found {
+		t.Errorf("got %v, want token excluded", *user)
+	}
+}
+
+func TestMixedProjectionFailsTheOperations(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann"}, bson.M{"name": "bob"})
+	mixed := func() *QuerySet {
+		return CreateQuery(bson.M{"name": "ann"}).Fields("name").ExcludeFields("token")
+	}
+
+	_, err := GetDocument(database, "users", mixed())
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("GetDocument: got %v, want ErrMixedProjection", err)
+	}
+
+	_, err = GetDocuments(database, "users", mixed())
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("GetDocuments: got %v, want ErrMixedProjection", err)
+	}
+
+	_, err = DeleteDocuments(database, "users", mixed())
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("DeleteDocuments: got %v, want ErrMixedProjection", err)
+	}
+
+	_, err = UpdateDocuments(database, "users", mixed(), bson.M{"$set": bson.M{"n": 1}})
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("UpdateDocuments: got %v, want ErrMixedProjection", err)
+	}
+
+	_, err = CountDocuments(database, "users", mixed())
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("CountDocuments: got %v, want ErrMixedProjection", err)
+	}
+
+	if stored, _ := CountDocuments(database, "users", CreateQuery(bson.M{"n": bson.M{"$exists": false}})); stored != 2 {
+		t.Errorf("got %d untouched documents, want both", stored)
+	}
+}
+
+func TestCreateQueryFromJSON(t *testing.T) {
+	query, err := CreateQueryFromJSON(`{"status": "paid", "total": {"$gte": 10}}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertFilter(t, query.Build(nil), bson.M{"status": "paid", "total": bson.M{"$gte": int32(10)}})
+
+	database := testDatabase(t)
+	seedDocuments(t, database, "orders", bson.M{"status": "paid", "total": 12}, bson.M{"status": "paid", "total": 3})
+
+	count, err := CountDocuments(database, "orders", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want 1", count)
+	}
+}
+
+func TestCreateQueryFromJSONRejectsInvalidJSON(t *testing.T) {
+	query, err := CreateQueryFromJSON(`{"status": `)
+
+	if query != nil || err == nil {
+		t.Errorf("got %v, %v, want an invalid JSON error", query, err)
+	}
+}
+
+func TestCreateQueryFromJSONRejectsServerSideJavaScript(t *testing.T) {
+	for _, filter := range []string{
+		`{"$where": "this.total > 10"}`,
+		`{"$or": [{"status": "paid"}, {"$where": "sleep(1000)"}]}`,
+		`{"$expr": {"$function": {"body": "function() { return true }", "args": [], "lang": "js"}}}`,
+	} {
+		query, err := CreateQueryFromJSON(filter)
+
+		if query != nil || !errors.Is(err, ErrUnsafeOperator) {
+			t.Errorf("%s: got %v, %v, want ErrUnsafeOperator", filter, query, err)
+		}
+	}
+}
+
+var (
+	sanitizeFields    = []string{"status", "total", "items", "sku"}
+	sanitizeOperators = []string{"$gte", "$lte", "$in", "$elemMatch", "$not"}
+)
+
+func TestJoinLookupLeavesTheJoinQueryAsIs(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"_id": 1, "active": true, "secret": "x"}, bson.M{"_id": 2, "active": false, "secret": "y"})
+	seedDocuments(t, database, "orders", bson.M{"n": 1, "user": 1}, bson.M{"n": 2, "user": 2}, bson.M{"n": 3, "user": 1})
+	users := CreateQuery(bson.M{"active": true}).ExcludeFields("secret")
+
+	orders, err := GetDocumentsTyped[numbered](
+		database,
+		"orders",
+		CreateQuery().Join("user", "_id", "users", users).Sort(bson.M{"n": 1}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orders) != 2 || orders[0].N != 1 || orders[1].N != 3 {
+		t.Errorf("got %v, want the orders of the active user", orders)
+	}
+
+	if users.Err != nil {
+		t.Errorf("got %v recorded on the join query, want none", users.Err)
+	}
+
+	assertFilter(t, users.FindOptions.Projection, bson.M{"secret": 0})
+}
+
+func TestJoinErrorsFailTheOperations(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 3)
+	seedDocuments(t, database, "users", bson.M{"_id": 1})
+
+	for name, users := range map[string]*QuerySet{
+		"query error":  CreateQuery().WithinPolygon("location", nil),
+		"server error": CreateQuery(bson.M{"_id": bson.M{"$bogus": 1}}),
+	} {
+		query := CreateQuery().Join("user", "_id", "users", users)
+
+		_, err := DeleteDocuments(database, "items", query)
+
+		if err == nil {
+			t.Errorf("%s: DeleteDocuments got no error, want the lookup error", name)
+		}
+
+		_, err = UpdateDocuments(database, "items", query, bson.M{"$set": bson.M{"updated": true}})
+
+		if err == nil {
+			t.Errorf("%s: UpdateDocuments got no error, want the lookup error", name)
+		}
+
+		_, err = GroupCount(database, "items", "n", query)
+
+		if err == nil {
+			t.Errorf("%s: GroupCount got no error, want the lookup error", name)
+		}
+
+		_, err = CreateBulk().DeleteOne(query).Execute(database, "items")
+
+		if err == nil {
+			t.Errorf("%s: the bulk write got no error, want the lookup error", name)
+		}
+	}
+
+	if count, _ := CountDocuments(database, "items", CreateQuery(bson.M{"updated": bson.M{"$exists": false}})); count != 3 {
+		t.Errorf("got %d untouched documents, want all 3", count)
+	}
+}
+
+func TestFailedJoinsBuildToAFilterMatchingNothing(t *testing.T) {
+	query := CreateQuery(bson.M{"n": 1}).Join("user", "_id", "users", CreateQuery().WithinPolygon("location", nil))
+
+	assertFilter(t, query.Build(unreachableDatabase(t)), bson.M{"$and": bson.A{
+		bson.M{"n": 1},
+		bson.M{"user": bson.M{"$in": bson.A{}}},
+	}})
+
+	_, err := CountDocuments(unreachableDatabase(t), "items", query)
+
+	if !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("got %v, want the error of the join query", err)
+	}
+}
+
+func TestSanitizeAcceptsACleanFilter(t *testing.T) {
+	query, err := CreateQueryFromJSON(`{
+		"$or": [
+			{"status": "paid", "total": {"$gte": 10}},
+			{"$and": [{"status": {"$in": ["open", "late"]}}, {"total": {"$not": {"$lte": 5}}}]}
+		],
+		"items": {"$elemMatch": {"sku": "a"}}
+	}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = query.Sanitize(sanitizeFields, sanitizeOperators); err != nil {
+		t.Errorf("got %v, want the filter accepted", err)
+	}
+}
+
+func TestSanitizeRejectsNestedViolations(t *testing.T) {
+	for filter, want := range map[string]error{
+		`{"$or": [{"status": "paid"}, {"$nor": [{"password": "x"}]}]}`: ErrFieldNotAllowed,
+		`{"$and": [{"status": "paid"}, {"total": {"$regex": "^1"}}]}`:  ErrOperatorNotAllowed,
+		`{"total": {"$not": {"$regex": "^1"}}}`:                        ErrOperatorNotAllowed,
+		`{"items": {"$elemMatch": {"secret": 1}}}`:                     ErrFieldNotAllowed,
+		`{"$expr": {"$gt": ["$total", 1]}}`:                            ErrOperatorNotAllowed,
+		`{"$or": {"status": "paid"}}`:                                  ErrOperatorNotAllowed,
+	} {
+		query, err := CreateQueryFromJSON(filter)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = query.Sanitize(sanitizeFields, sanitizeOperators); !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", filter, err, want)
+		}
+	}
+}
+
+func TestSanitizeChecksEveryFilter(t *testing.T) {
+	query := CreateQuery(bson.M{"status": "paid"}).Filter(bson.M{"internal": true})
+
+	if err := query.Sanitize(sanitizeFields, sanitizeOperators); !errors.Is(err, ErrFieldNotAllowed) {
+		t.Errorf("got %v, want ErrFieldNotAllowed", err)
+	}
+}
+
+func TestSanitizeTreatsRegexValuesAsTheRegexOperator(t *testing.T) {
+	regex := primitive.Regex{Pattern: "^a"}
+
+	for name, filter := range map[string]bson.M{
+		"literal": {"status": regex},
+		"pointer": {"status": &regex},
+		"$in":     {"status": bson.M{"$in": bson.A{"open", regex}}},
+		"$nin":    {"status": bson.M{"$nin": []interface{}{regex}}},
+		"$all":    {"items": bson.M{"$all": bson.A{regex}}},
+		"$not":    {"status": bson.M{"$not": regex}},
+	} {
+		err := CreateQuery(filter).Sanitize(sanitizeFields, sanitizeOperators)
+
+		if !errors.Is(err, ErrOperatorNotAllowed) {
+			t.Errorf("%s: got %v, want ErrOperatorNotAllowed", name, err)
+		}
+
+		err = CreateQuery(filter).Sanitize(sanitizeFields, append(sanitizeOperators, "$nin", "$all", "$regex"))
+
+		if err != nil {
+			t.Errorf("%s: got %v, want the filter accepted once $regex is allowed", name, err)
+		}
+	}
+}
+
+func TestSanitizeRejectsRegexesFromJSON(t *testing.T) {
+	query, err := CreateQueryFromJSON(`{"status": {"$in": [{"$regularExpression": {"pattern": "^a", "options": ""}}]}}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = query.Sanitize(sanitizeFields, sanitizeOperators); !errors.Is(err, ErrOperatorNotAllowed) {
+		t.Errorf("got %v, want ErrOperatorNotAllowed", err)
+	}
+}
+
+func TestNearBuildsTheGeoFilter(t *testing.T) {
+	assertFilter(t, CreateQuery().Near("location", 10.75, 59.91, 500).Build(nil), bson.M{
+		"location": bson.M{
+			"$near": bson.M{
+				"$geometry":    bson.M{"type": "Point", "coordinates": bson.A{10.75, 59.91}},
+				"$maxDistance": 500.0,
+			},
+		},
+	})
+}
+
+func TestNearReturnsTheClosePlacesNearestFirst(t *testing.T) {
+	database := testDatabase(t)
+	point := func(longitude, latitude float64) bson.M {
+		return bson.M{"type": "Point", "coordinates": bson.A{longitude, latitude}}
+	}
+	seedDocuments(
+		t,
+		database,
+		"places",
+		bson.M{"name": "far", "location": point(11.5, 60.5)},
+		bson.M{"name": "second", "location": point(10.754, 59.91)},
+		bson.M{"name": "first", "location": point(10.7501, 59.9101)},
+	)
+
+	_, err := CreateGeoIndex(database, "places", "location")
+	skipIfIndexUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	places, err := GetDocumentsTyped[bson.M](database, "places", CreateQuery().Near("location", 10.75, 59.91, 1000))
+	skipIfIndexUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(places) != 2 || places[0]["name"] != "first" || places[1]["name"] != "second" {
+		t.Errorf("got %v, want first and second, in that order", places)
+	}
+}
+
+func TestWithinPolygonClosesTheRing(t *testing.T) {
+	query := CreateQuery().WithinPolygon("location", [][]float64{{0, 0}, {4, 0}, {4, 4}, {0, 4}})
+
+	if query.Err != nil {
+		t.Fatal(query.Err)
+	}
+
+	assertFilter(t, query.Build(nil), bson.M{
+		"location": bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": bson.A{bson.A{bson.A{0.0, 0.0}, bson.A{4.0, 0.0}, bson.A{4.0, 4.0}, bson.A{0.0, 4.0}, bson.A{0.0, 0.0}}},
+				},
+			},
+		},
+	})
+
+	closed := CreateQuery().WithinPolygon("location", [][]float64{{0, 0}, {4, 0}, {4, 4}, {0, 0}})
+
+	assertFilter(t, closed.Build(nil), bson.M{
+		"location": bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": bson.A{bson.A{bson.A{0.0, 0.0}, bson.A{4.0, 0.0}, bson.A{4.0, 4.0}, bson.A{0.0, 0.0}}},
+				},
+			},
+		},
+	})
+}
+
+func TestWithinPolygonDropsRepeatedPoints(t *testing.T) {
+	query := CreateQuery().WithinPolygon("location", [][]float64{{0, 0}, {4, 0}, {4, 0}, {4, 4}, {0, 0}, {0, 0}})
+
+	if query.Err != nil {
+		t.Fatal(query.Err)
+	}
+
+	assertFilter(t, query.Build(nil), bson.M{
+		"location": bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": bson.A{bson.A{bson.A{0.0, 0.0}, bson.A{4.0, 0.0}, bson.A{4.0, 4.0}, bson.A{0.0, 0.0}}},
+				},
+			},
+		},
+	})
+}
+
+func TestWithinPolygonRejectsInvalidPolygons(t *testing.T) {
+	for name, points := range map[string][][]float64{
+		"empty":      nil,
+		"two points": {{0, 0}, {1, 1}},
+		"closed two": {{0, 0}, {1, 1}, {0, 0}},
+		"bad point":  {{0, 0}, {1}, {1, 1}},
+		"repeated":   {{0, 0}, {1, 0}, {0, 0}, {0, 0}},
+		"revisited":  {{0, 0}, {1, 0}, {0, 0}, {1, 0}},
+	} {
+		query := CreateQuery().WithinPolygon("location", points)
+
+		if !errors.Is(query.Err, ErrInvalidPolygon) || len(query.Query) != 0 {
+			t.Errorf("%s: got %v with filters %v, want ErrInvalidPolygon and no filter", name, query.Err, query.Query)
+		}
+	}
+}
+
+func TestInvalidPolygonsMatchNothing(t *testing.T) {
+	query := CreateQuery(bson.M{"open": true}).WithinPolygon("location", [][]float64{{0, 0}, {1, 0}, {0, 0}})
+
+	assertFilter(t, query.Build(nil), bson.M{"_id": bson.M{"$in": bson.A{}}})
+
+	if _, err := CreateAggregate().Match(query).BuildChecked(nil); !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("got %v, want ErrInvalidPolygon", err)
+	}
+
+	database := testDatabase(t)
+	seedDocuments(t, database, "places", bson.M{"name": "outside", "open": true})
+
+	places, err := AggregateTyped[bson.M](database, "places", CreateAggregate().Match(query).Build(database))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(places) != 0 {
+		t.Errorf("got %v, want no place matched by the invalid polygon", places)
+	}
+}
+
+func TestWithinPolygonFilters(t *testing.T) {
+	database := testDatabase(t)
+	point := func(name string, longitude, latitude float64) bson.M {
+		return bson.M{"name": name, "location": bson.M{"type": "Point", "coordinates": bson.A{longitude, latitude}}}
+	}
+	seedDocuments(t, database, "places", point("inside", 2, 2), point("outside", 5, 5), point("edge", 1, 3.9))
+
+	places, err := GetDocumentsTyped[bson.M](
+		database,
+		"places",
+		CreateQuery().WithinPolygon("location", [][]float64{{0, 0}, {4, 0}, {4, 4}, {0, 4}}).Sort(bson.M{"name": 1}),
+	)
+	skipIfUnknownOperator(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(places) != 2 || places[0]["name"] != "edge" || places[1]["name"] != "inside" {
+		t.Errorf("got %v, want the places inside the square", places)
+	}
+}
+
+func TestQueryErrorsFailEveryHelper(t *testing.T) {
+	database := unreachableDatabase(t)
+	invalid := CreateQuery().WithinPolygon("location", nil)
+
+	_, err := CountDocuments(database, "places", invalid)
+
+	if !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("CountDocuments: got %v, want ErrInvalidPolygon", err)
+	}
+
+	_, err = DeleteDocuments(database, "places", invalid)
+
+	if !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("DeleteDocuments: got %v, want ErrInvalidPolygon", err)
+	}
+
+	_, err = DistinctValues(database, "places", "name", invalid)
+
+	if !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("DistinctValues: got %v, want ErrInvalidPolygon", err)
+	}
+
+	_, err = GroupCount(database, "places", "name", invalid)
+
+	if !errors.Is(err, ErrInvalidPolygon) {
+		t.Errorf("GroupCount: got %v, want ErrInvalidPolygon", err)
+	}
+}
+
+func TestFacetCountsEveryField(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"products",
+		bson.M{"category": "books", "color": "red", "stock": 1},
+		bson.M{"category": "books", "color": "blue", "stock": 1},
+		bson.M{"category": "games", "color": "red", "stock": 1},
+		bson.M{"category": "games", "color": "red", "stock": 0},
+	)
+
+	facets, err := Facet(database, "products", CreateQuery(bson.M{"stock": bson.M{"$gt": 0}}), "category", "color")
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]int64{
+		"category": {"books": 2, "games": 1},
+		"color":    {"red": 2, "blue": 1},
+	}
+
+	if len(facets) != len(want) {
+		t.Fatalf("got %v, want %v", facets, want)
+	}
+
+	for field, counts := range want {
+		if len(facets[field]) != len(counts) {
+			t.Errorf("%s: got %v, want %v", field, facets[field], counts)
+			continue
+		}
+
+		for value, count := range counts {
+			if facets[field][value] != count {
+				t.Errorf("%s: got %v, want %v", field, facets[field], counts)
+			}
+		}
+	}
+}
+
+func TestFacetWithoutFields(t *testing.T) {
+	database := unreachableDatabase(t)
+
+	facets, err := Facet(database, "products", CreateQuery())
+
+	if err != nil || len(facets) != 0 {
+		t.Errorf("got %v and %v, want no facets and no error", facets, err)
+	}
+
+	_, err = Facet(database, "products", CreateQuery().ExcludeFields("a").Fields("b"), "category")
+
+	if !errors.Is(err, ErrMixedProjection) {
+		t.Errorf("got %v, want the query error", err)
+	}
+}
+
+func TestSampleDocumentsSize(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 50)
+
+	sample, err := SampleDocuments[numbered](database, "items", CreateQuery(bson.M{"n": bson.M{"$lte": 40}}), 5)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sample) != 5 {
+		t.Fatalf("got %d documents, want 5", len(sample))
+	}
+
+	seen := map[int]bool{}
+
+	for _, item := range sample {
+		if item.N < 1 || item.N > 40 || seen[item.N] {
+			t.Errorf("got %v, want distinct documents matching the query", sample)
+		}
+
+		seen[item.N] = true
+	}
+
+	sample, err = SampleDocuments[numbered](database, "items", CreateQuery(bson.M{"n": bson.M{"$lte": 3}}), 5)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sample) != 3 {
+		t.Errorf("got %d documents, want the 3 matching ones", len(sample))
+	}
+}
+
+func TestSampleDocumentsVary(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 50)
+	samples := map[string]bool{}
+
+	for i_ := 0; i_ < 10 && len(samples) < 2; i_++ {
+		sample, err := SampleDocuments[numbered](database, "items", CreateQuery(), 3)
+		skipIfNotImplemented(t, err)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		samples[fmt.Sprint(sample)] = true
+	}
+
+	if len(samples) < 2 {
+		t.Errorf("got the same sample %v on every call", samples)
+	}
+}
+
+func TestSampleDocumentsRejectsInvalidSizes(t *testing.T) {
+	database := unreachableDatabase(t)
+
+	for _, size := range []int{0, -1} {
+		_, err := SampleDocuments[numbered](database, "items", CreateQuery(), size)
+
+		if !errors.Is(err, ErrInvalidSampleSize) {
+			t.Errorf("size %d: got %v, want ErrInvalidSampleSize", size, err)
+		}
+	}
+}
+
+func TestUnsetFields(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"users",
+		bson.M{"name": "a", "legacy": 1, "old": true, "active": true},
+		bson.M{"name": "b", "legacy": 2, "old": true, "active": true},
+		bson.M{"name": "c", "legacy": 3, "old": true, "active": false},
+	)
+
+	result, err := UnsetFields(database, "users", CreateQuery(bson.M{"active": true}), "legacy", "old")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.MatchedCount != 2 || result.ModifiedCount != 2 {
+		t.Errorf("got %+v, want 2 modified documents", result)
+	}
+
+	unset, err := CountDocuments(database, "users", CreateQuery(bson.M{"legacy": bson.M{"$exists": false}, "old": bson.M{"$exists": false}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unset != 2 {
+		t.Errorf("got %d documents without the fields, want 2", unset)
+	}
+
+	kept, err := CountDocuments(database, "users", CreateQuery(bson.M{"name": "c", "legacy": 3, "old": true}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kept != 1 {
+		t.Error("the unmatched document lost its fields")
+	}
+}
+
+func TestUnsetFieldsWithoutFields(t *testing.T) {
+	result, err := UnsetFields(unreachableDatabase(t), "users", CreateQuery())
+
+	if err != nil || result.MatchedCount != 0 {
+		t.Errorf("got %+v and %v, want an empty result without a round trip", result, err)
+	}
+}
+
+func TestRenameFieldOnASubset(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"users",
+		bson.M{"name": "a", "mail": "a@example.com", "migrate": true},
+		bson.M{"name": "b", "mail": "b@example.com", "migrate": true},
+		bson.M{"name": "c", "mail": "c@example.com", "migrate": false},
+	)
+
+	result, err := RenameField(database, "users", CreateQuery(bson.M{"migrate": true}), "mail", "email")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.MatchedCount != 2 || result.ModifiedCount != 2 {
+		t.Errorf("got %+v, want 2 modified documents", result)
+	}
+
+	users, err := GetDocumentsTyped[bson.M](database, "users", CreateQuery().Sort(bson.M{"name": 1}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 3 {
+		t.Fatalf("got %v, want 3 users", users)
+	}
+
+	for _, user := range users[:2] {
+		if _, ok := user["mail"]; ok || user["email"] != user["name"].(string)+"@example.com" {
+			t.Errorf("got %v, want the field renamed to email", user)
+		}
+	}
+
+	if _, ok := users[2]["email"]; ok || users[2]["mail"] != "c@example.com" {
+		t.Errorf("got %v, want the unmatched user unchanged", users[2])
+	}
+}
+
+// Returns the MONGODB_TEST_URI url, dropping its shared client once the test ends.
+// Skips the test when MONGODB_TEST_URI is unset.
+func sharedTestURL(t *testing.T) string {
+	t.Helper()
+
+	url := os.Getenv("MONGODB_TEST_URI")
+
+	if url == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	t.Cleanup(func() {
+		sharedClients.Lock()
+		entry := sharedClients.clients[url]
+		delete(sharedClients.clients, url)
+		sharedClients.Unlock()
+
+		if entry != nil && entry.client != nil {
+			_ = entry.client.Disconnect(context.Background())
+		}
+	})
+
+	return url
+}
+
+func TestGetSharedDatabaseReusesTheClient(t *testing.T) {
+	url := sharedTestURL(t)
+
+	first, err := GetSharedDatabase(url, "mongodbutilities_test_a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := GetSharedDatabase(url, "mongodbutilities_test_b")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Client() != second.Client() {
+		t.Error("got a new client, want the cached one")
+	}
+
+	if second.Name() != "mongodbutilities_test_b" {
+		t.Errorf("got database %s, want mongodbutilities_test_b", second.Name())
+	}
+}
+
+func TestGetSharedDatabaseReconnects(t *testing.T) {
+	url := sharedTestURL(t)
+
+	first, err := GetSharedDatabase(url, "mongodbutilities_test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = first.Client().Disconnect(context.Background())
+
+	second, err := GetSharedDatabase(url, "mongodbutilities_test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Client() == second.Client() {
+		t.Error("got the disconnected client, want a new one")
+	}
+
+	if err := second.Client().Ping(context.Background(), nil); err != nil {
+		t.Errorf("the new client is unusable: %v", err)
+	}
+}
+
+func TestGetSharedDatabaseDoesNotBlockOtherURLs(t *testing.T) {
+	url := sharedTestURL(t)
+	unreachable := "mongodb://127.0.0.1:1"
+	done := make(chan struct{})
+
+	t.Cleanup(func() {
+		<-done
+		sharedClients.Lock()
+		delete(sharedClients.clients, unreachable)
+		sharedClients.Unlock()
+	})
+
+	go func() {
+		defer close(done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+
+		defer cancel()
+
+		_, _ = GetSharedDatabaseCtx(ctx, unreachable, "mongodbutilities_test")
+	}()
+
+	// Lets the connection to the unreachable url start.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	_, err := GetSharedDatabase(url, "mongodbutilities_test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the call waited %v on the connection to another url", elapsed)
+	}
+
+	select {
+	case <-done:
+		t.Error("the connection to the unreachable url ended early, the test proves nothing")
+	default:
+	}
+}
+
+func TestGetSharedDatabaseConcurrently(t *testing.T) {
+	url := sharedTestURL(t)
+	clients := make([]*mongo.Client, 8)
+	group := sync.WaitGroup{}
+
+	for i_ := range clients {
+		group.Add(1)
+
+		go func(i_ int) {
+			defer group.Done()
+
+			database, err := GetSharedDatabase(url, "mongodbutilities_test")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			clients[i_] = database.Client()
+		}(i_)
+	}
+
+	group.Wait()
+
+	for i_ := range clients {
+		if clients[i_] != clients[0] {
+			t.Fatal("got several clients for the same url, want one")
+		}
+	}
+}
+
+func TestNewContextUsesDefaultTimeout(t *testing.T) {
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		t.Fatal("got a context without a deadline")
+	}
+
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > DefaultTimeout {
+		t.Errorf("got a deadline in %v, want one within %v", remaining, DefaultTimeout)
+	}
+
+	cancel()
+
+	if ctx.Err() != context.Canceled {
+		t.Errorf("got %v after cancel, want context.Canceled", ctx.Err())
+	}
+}
+
+func TestGetCollectionIsUsable(t *testing.T) {
+	database := testDatabase(t)
+	collection := GetCollection(database, "items")
+
+	if collection.Name() != "items" || collection.Database().Name() != database.Name() {
+		t.Fatalf("got collection %s.%s, want %s.items", collection.Database().Name(), collection.Name(), database.Name())
+	}
+
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, bson.M{"name": "a"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := CountDocuments(database, "items", CreateQuery(bson.M{"name": "a"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 {
+		t.Errorf("got %d documents, want the one inserted through the raw collection", count)
+	}
+}
+
+func TestUnwindStage(t *testing.T) {
+	pipeline := CreateAggregate().
+		Lookup("orders", "_id", "user", "orders").
+		Unwind("orders", true).
+		Unwind("$tags", false).
+		Build(nil)
+
+	got := stageNames(pipeline)
+
+	if len(got) != 3 || got[1] != "$unwind" || got[2] != "$unwind" {
+		t.Fatalf("got %v, want a $lookup and two $unwind stages", got)
+	}
+
+	assertFilter(t, pipeline[1][0].Value, bson.M{"path": "$orders", "preserveNullAndEmptyArrays": true})
+	assertFilter(t, pipeline[2][0].Value, bson.M{"path": "$tags", "preserveNullAndEmptyArrays": false})
+}
+
+func TestLookupAndUnwindJoin(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"_id": 1, "name": "a"}, bson.M{"_id": 2, "name": "b"})
+	seedDocuments(t, database, "orders", bson.M{"_id": 10, "user": 1, "total": 5}, bson.M{"_id": 11, "user": 1, "total": 7})
+
+	type joined struct {
+		Name   string   `bson:"name"`
+		Orders []bson.M `bson:"orders"`
+	}
+
+	users, err := AggregateTyped[joined](
+		database,
+		"users",
+		CreateAggregate().Lookup("orders", "_id", "user", "orders").Sort(bson.M{"_id": 1}).Build(database),
+	)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 || len(users[0].Orders) != 2 || len(users[1].Orders) != 0 {
+		t.Errorf("got %+v, want user a with 2 orders and user b with none", users)
+	}
+
+	type unwound struct {
+		Name   string `bson:"name"`
+		Orders *struct {
+			Total int `bson:"total"`
+		} `bson:"orders"`
+	}
+
+	for _, preserve := range []bool{true, false} {
+		rows, err := AggregateTyped[unwound](
+			database,
+			"users",
+			CreateAggregate().
+				Lookup("orders", "_id", "user", "orders").
+				Unwind("orders", preserve).
+				Sort(bson.D{{Key: "name", Value: 1}, {Key: "orders.total", Value: 1}}).
+				Build(database),
+		)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := 2
+
+		if preserve {
+			want = 3
+		}
+
+		if len(rows) != want {
+			t.Fatalf("preserve %v: got %+v, want %d rows", preserve, rows, want)
+		}
+
+		if rows[0].Orders == nil || rows[0].Orders.Total != 5 || rows[1].Orders == nil || rows[1].Orders.Total != 7 {
+			t.Errorf("preserve %v: got %+v, want a row per order of user a", preserve, rows)
+		}
+
+		if preserve && (rows[2].Name != "b" || rows[2].Orders != nil) {
+			t.Errorf("got %+v, want user b kept without orders", rows[2])
+		}
+	}
+}
+
+func TestGetDocumentsWithCount(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 57)
+
+	items, total, err := GetDocumentsWithCount[numbered](
+		database,
+		"items",
+		CreateQuery(bson.M{"n": bson.M{"$gt": 7}}).Sort(bson.M{"n": 1}).Skip(10).Limit(10),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 50 {
+		t.Errorf("got a total of %d, want 50 ignoring skip and limit", total)
+	}
+
+	if len(items) != 10 || items[0].N != 18 || items[9].N != 27 {
+		t.Errorf("got %v, want documents 18 to 27", items)
+	}
+}
+
+func TestCreatePartialIndexUniqueness(t *testing.T) {
+	database := testDatabase(t)
+
+	name, err := CreatePartialIndex(
+		database,
+		"users",
+		bson.D{{Key: "email", Value: 1}},
+		bson.M{"deleted": false},
+		true,
+	)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := indexNames(t, database, "users")[name]
+
+	if index == nil || index["unique"] != true {
+		t.Fatalf("got %v, want a unique index named %s", index, name)
+	}
+
+	assertFilter(t, index["partialFilterExpression"], bson.M{"deleted": false})
+
+	for i_ := 0; i_ < 2; i_++ {
+		_, err = InsertDocument(database, "users", bson.M{"email": "a@example.com", "deleted": true})
+
+		if err != nil {
+			t.Fatalf("got %v inserting a duplicate excluded by the filter, want none", err)
+		}
+	}
+
+	_, err = InsertDocument(database, "users", bson.M{"email": "a@example.com", "deleted": false})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InsertDocument(database, "users", bson.M{"email": "a@example.com", "deleted": false})
+
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("got %v inserting a duplicate included by the filter, want a duplicate key error", err)
+	}
+}
+
+func TestPreviewDeleteMatchesTheDelete(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 10)
+	query := CreateQuery(bson.M{"n": bson.M{"$gt": 6}})
+
+	preview, err := PreviewDelete(database, "items", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remaining, err := CountMatching(database, "items", CreateQuery())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if preview != 4 || remaining != 10 {
+		t.Fatalf("got a preview of %d with %d documents left, want 4 and no deletion", preview, remaining)
+	}
+
+	res, err := DeleteDocuments(database, "items", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != preview {
+		t.Errorf("deleted %d documents, the preview counted %d", res.DeletedCount, preview)
+	}
+}
+
+func TestPreviewUpdateMatchesTheUpdate(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 10)
+	query := CreateQuery(bson.M{"n": bson.M{"$lte": 3}})
+
+	preview, err := PreviewUpdate(database, "items", query)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := CountMatching(database, "items", CreateQuery(bson.M{"flag": true}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if preview != 3 || updated != 0 {
+		t.Fatalf("got a preview of %d with %d documents updated, want 3 and no update", preview, updated)
+	}
+
+	res, err := UpdateDocuments(database, "items", query, bson.M{"$set": bson.M{"flag": true}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.MatchedCount != preview {
+		t.Errorf("updated %d documents, the preview counted %d", res.MatchedCount, preview)
+	}
+}
+
+func TestDecodeSingle(t *testing.T) {
+	document, err := DecodeSingle[bson.M](nil)
+
+	if document != nil || err != nil {
+		t.Errorf("nil result: got %v and %v, want nothing", document, err)
+	}
+
+	document, err = DecodeSingle[bson.M](mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil))
+
+	if document != nil || err != nil {
+		t.Errorf("no document: got %v and %v, want nothing", document, err)
+	}
+
+	failure := errors.New("failure")
+	document, err = DecodeSingle[bson.M](mongo.NewSingleResultFromDocument(bson.M{}, failure, nil))
+
+	if document != nil || !errors.Is(err, failure) {
+		t.Errorf("failed result: got %v and %v, want the error", document, err)
+	}
+
+	type user struct {
+		Name string `bson:"name"`
+	}
+
+	decoded, err := DecodeSingle[user](mongo.NewSingleResultFromDocument(bson.M{"name": "ann"}, nil, nil))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded == nil || decoded.Name != "ann" {
+		t.Errorf("got %+v, want the decoded document", decoded)
+	}
+}
+
+func TestDecodeSingleOfAHelper(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"name": "ann"})
+
+	res, err := GetDocument(database, "users", CreateQuery(bson.M{"name": "ann"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := DecodeSingle[bson.M](res)
+
+	if err != nil || document == nil || (*document)["name"] != "ann" {
+		t.Errorf("got %v and %v, want the stored document", document, err)
+	}
+
+	res, err = GetDocument(database, "users", CreateQuery(bson.M{"name": "bob"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document, err = DecodeSingle[bson.M](res)
+
+	if document != nil || err != nil {
+		t.Errorf("got %v and %v, want nothing for a missing document", document, err)
+	}
+}
+
+func TestArraySizeFilters(t *testing.T) {
+	assertFilter(t, CreateQuery().ArraySize("tags", 2).Build(nil), bson.M{"tags": bson.M{"$size": 2}})
+	assertFilter(t, CreateQuery().ArrayMinSize("tags", 2).Build(nil), bson.M{
+		"tags":   bson.M{"$exists": true},
+		"tags.1": bson.M{"$exists": true},
+	})
+	assertFilter(t, CreateQuery().ArrayMinSize("tags", 0).Build(nil), bson.M{"tags": bson.M{"$exists": true}})
+}
+
+func TestArraySizeMatching(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"posts",
+		bson.M{"n": 0, "tags": bson.A{}},
+		bson.M{"n": 1, "tags": bson.A{"a"}},
+		bson.M{"n": 2, "tags": bson.A{"a", "b"}},
+		bson.M{"n": 3, "tags": bson.A{"a", "b", "c"}},
+	)
+
+	for name, test := range map[string]struct {
+		query *QuerySet
+		want  []int
+	}{
+		"exactly 2":  {CreateQuery().ArraySize("tags", 2), []int{2}},
+		"exactly 0":  {CreateQuery().ArraySize("tags", 0), []int{0}},
+		"at least 2": {CreateQuery().ArrayMinSize("tags", 2), []int{2, 3}},
+		"at least 1": {CreateQuery().ArrayMinSize("tags", 1), []int{1, 2, 3}},
+	} {
+		posts, err := GetDocumentsTyped[numbered](database, "posts", test.query.Sort(bson.M{"n": 1}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(posts) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", name, posts, test.want)
+			continue
+		}
+
+		for i_, post := range posts {
+			if post.N != test.want[i_] {
+				t.Errorf("%s: got %v, want %v", name, posts, test.want)
+			}
+		}
+	}
+}
+
+func TestExprCompareFilter(t *testing.T) {
+	assertFilter(t, CreateQuery().ExprCompare("$gt", "spent", "budget").Build(nil), bson.M{
+		"$expr": bson.M{"$gt": bson.A{"$spent", "$budget"}},
+	})
+
+	for _, op := range []string{"gt", "$in", "$where", ""} {
+		query := CreateQuery().ExprCompare(op, "spent", "budget")
+
+		if !errors.Is(query.Err, ErrInvalidOperator) || len(query.Query) != 0 {
+			t.Errorf("%q: got %v with filters %v, want ErrInvalidOperator and no filter", op, query.Err, query.Query)
+		}
+	}
+}
+
+func TestExprCompareMatching(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"projects",
+		bson.M{"n": 1, "spent": 5, "budget": 10},
+		bson.M{"n": 2, "spent": 15, "budget": 10},
+		bson.M{"n": 3, "spent": 10, "budget": 10},
+	)
+
+	projects, err := GetDocumentsTyped[numbered](database, "projects", CreateQuery().ExprCompare("$gt", "spent", "budget"))
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 1 || projects[0].N != 2 {
+		t.Errorf("got %v, want the over budget project", projects)
+	}
+
+	projects, err = GetDocumentsTyped[numbered](
+		database,
+		"projects",
+		CreateQuery().ExprCompare("$gte", "spent", "budget").Sort(bson.M{"n": 1}),
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 2 || projects[0].N != 2 || projects[1].N != 3 {
+		t.Errorf("got %v, want the projects at or over budget", projects)
+	}
+}
+
+func TestFailedQuerySetsBuildToAFilterMatchingNothing(t *testing.T) {
+	query := CreateQuery(bson.M{"archived": false}).ExprCompare("$bogus", "spent", "budget")
+
+	assertFilter(t, query.Build(nil), bson.M{"_id": bson.M{"$in": bson.A{}}})
+
+	if _, err := query.BuildChecked(nil); !errors.Is(err, ErrInvalidOperator) {
+		t.Errorf("BuildChecked: got %v, want ErrInvalidOperator", err)
+	}
+
+	aggregate := CreateAggregate().Match(query).Limit(1)
+
+	if _, err := aggregate.BuildChecked(nil); !errors.Is(err, ErrInvalidOperator) {
+		t.Errorf("AggregateSet.BuildChecked: got %v, want ErrInvalidOperator", err)
+	}
+
+	pipeline, err := CreateAggregate().Match(CreateQuery(bson.M{"n": 1})).Limit(1).BuildChecked(nil)
+
+	if err != nil || len(pipeline) != 2 {
+		t.Errorf("got %v and %v, want the 2 stages built", pipeline, err)
+	}
+}
+
+func TestInvalidMatchStagesMatchNothing(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "projects", 3)
+
+	pipeline := CreateAggregate().Match(CreateQuery().ExprCompare("$bogus", "spent", "budget")).Build(database)
+	projects, err := AggregateTyped[numbered](database, "projects", pipeline)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(projects) != 0 {
+		t.Errorf("got %v, want no project matched by the rejected filter", projects)
+	}
+}
+
+func TestMergeQueriesIsFlat(t *testing.T) {
+	tenant := CreateQuery(bson.M{"tenant": "a"})
+	visible := CreateQuery(bson.M{"$and": bson.A{bson.M{"deleted": false}, bson.M{"$and": bson.A{bson.M{"public": true}}}}})
+	search := CreateQuery(bson.M{"name": "ann"}, bson.M{"age": bson.M{"$gt": 30}})
+
+	merged := MergeQueries(tenant, nil, visible, search)
+
+	if len(merged.Query) != 5 {
+		t.Fatalf("got %v, want 5 flat filters", merged.Query)
+	}
+
+	assertFilter(t, merged.Build(nil), bson.M{"$and": bson.A{
+		bson.M{"tenant": "a"},
+		bson.M{"deleted": false},
+		bson.M{"public": true},
+		bson.M{"name": "ann"},
+		bson.M{"age": bson.M{"$gt": 30}},
+	}})
+}
+
+func TestMergeQueriesKeepsMixedFilters(t *testing.T) {
+	mixed := bson.M{"$and": bson.A{bson.M{"deleted": false}}, "tenant": "a"}
+
+	merged := MergeQueries(CreateQuery(mixed), CreateQuery(bson.M{"name": "ann"}))
+
+	assertFilter(t, merged.Build(nil), bson.M{"$and": bson.A{mixed, bson.M{"name": "ann"}}})
+}
+
+func TestMergeQueriesCarriesErrors(t *testing.T) {
+	merged := MergeQueries(CreateQuery(), CreateQuery().ExprCompare("bad", "a", "b"))
+
+	if !errors.Is(merged.Err, ErrInvalidOperator) {
+		t.Errorf("got %v, want the error of the second set", merged.Err)
+	}
+}
+
+func TestMergeQueriesMatchesTheSameDocuments(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 10)
+	lower := CreateQuery(bson.M{"$and": bson.A{bson.M{"n": bson.M{"$gt": 2}}}})
+	upper := CreateQuery(bson.M{"n": bson.M{"$lt": 6}})
+
+	merged, err := CountDocuments(database, "items", MergeQueries(lower, upper))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combined, err := CountDocuments(database, "items", CreateQuery(bson.M{"n": bson.M{"$gt": 2}}, bson.M{"n": bson.M{"$lt": 6}}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged != 3 || merged != combined {
+		t.Errorf("got %d documents for the merged query and %d for the combined one, want 3", merged, combined)
+	}
+}
+
+func TestOpOptionsContext(t *testing.T) {
+	for timeout, want := range map[time.Duration]time.Duration{0: DefaultTimeout, -time.Second: DefaultTimeout, time.Second: time.Second} {
+		ctx, cancel := OpOptions{Timeout: timeout}.Context()
+		deadline, ok := ctx.Deadline()
+		cancel()
+
+		if remaining := time.Until(deadline); !ok || remaining <= 0 || remaining > want {
+			t.Errorf("timeout %v: got a deadline in %v, want one within %v", timeout, remaining, want)
+		}
+	}
+}
+
+func TestOpOptionsTimeoutOverridesTheDefault(t *testing.T) {
+	database := unreachableDatabase(t)
+	opts := OpOptions{Timeout: 50 * time.Millisecond}
+
+	for name, call := range map[string]func() error{
+		"InsertDocumentOpts": func() error {
+			_, err := InsertDocumentOpts(database, "items", bson.M{"name": "a"}, opts)
+			return err
+		},
+		"GetDocumentsTypedOpts": func() error {
+			_, err := GetDocumentsTypedOpts[bson.M](database, "items", CreateQuery(), opts)
+			return err
+		},
+		"UpdateDocumentsOpts": func() error {
+			_, err := UpdateDocumentsOpts(database, "items", CreateQuery(), bson.M{"$set": bson.M{"n": 1}}, opts)
+			return err
+		},
+		"DeleteDocumentOpts": func() error {
+			_, err := DeleteDocumentOpts(database, "items", CreateQuery(), opts)
+			return err
+		},
+		"CountDocumentsOpts": func() error {
+			_, err := CountDocumentsOpts(database, "items", CreateQuery(), opts)
+			return err
+		},
+	} {
+		start := time.Now()
+		err := call()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want context.DeadlineExceeded", name, err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: the timeout was not applied, the call took %v", name, elapsed)
+		}
+	}
+}
+
+func TestOpOptionsRoundTrip(t *testing.T) {
+	database := testDatabase(t)
+	opts := OpOptions{Timeout: 10 * time.Second}
+
+	_, err := InsertDocumentsOpts(database, "items", []interface{}{bson.M{"n": 1}, bson.M{"n": 2}}, opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := GetDocumentTypedOpts[numbered](database, "items", CreateQuery(bson.M{"n": 2}), opts)
+
+	if err != nil || item == nil || item.N != 2 {
+		t.Fatalf("got %v and %v, want document 2", item, err)
+	}
+
+	_, err = UpdateDocumentOpts(database, "items", CreateQuery(bson.M{"n": 2}), bson.M{"$set": bson.M{"n": 3}}, opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DeleteDocumentsOpts(database, "items", CreateQuery(bson.M{"n": 1}), opts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := CountDocumentsOpts(database, "items", CreateQuery(bson.M{"n": 3}), opts)
+
+	if err != nil || count != 1 {
+		t.Errorf("got %d documents and %v, want the only, updated, document", count, err)
+	}
+}
+
+func TestSaveModelResultReportsCreation(t *testing.T) {
+	database := testDatabase(t)
+	user := &testTimestampedUser{Name: "ann"}
+
+	created, err := SaveModelResult(user, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !created || user.ID == primitive.NilObjectID {
+		t.Errorf("insert: got created %v and _id %v, want a created document", created, user.ID)
+	}
+
+	user.Name = "anne"
+	created, err = SaveModelResult(user, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created {
+		t.Error("update: got created, want updated")
+	}
+
+	if stored := storedDocument(t, database, "users", user.ID); stored["name"] != "anne" {
+		t.Errorf("got %v, want the updated document", stored)
+	}
+}
+
+func TestSaveModelResultLeavesMissingDocumentsMissing(t *testing.T) {
+	database := testDatabase(t)
+	user := &testTimestampedUser{ID: primitive.NewObjectID(), Name: "ann"}
+
+	created, err := SaveModelResult(user, database, "users")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if created {
+		t.Error("got created, want the same write as SaveModel")
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery(bson.M{}))
+
+	if err != nil || count != 0 {
+		t.Errorf("got %d documents and %v, want none", count, err)
+	}
+}
+
+func TestSaveModelResultUpsertsMissingDocuments(t *testing.T) {
+	database := testDatabase(t)
+	user := &testTimestampedUser{ID: primitive.NewObjectID(), Name: "ann"}
+
+	created, err := SaveModelResultWithOptions(user, database, "users", SaveOptions{Upsert: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !created {
+		t.Error("got updated, want the missing document upserted")
+	}
+
+	if stored := storedDocument(t, database, "users", user.ID); stored["name"] != "ann" {
+		t.Errorf("got %v, want the upserted document", stored)
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery(bson.M{}))
+
+	if err != nil || count != 1 {
+		t.Errorf("got %d documents and %v, want 1", count, err)
+	}
+}
+
+func TestSaveModelResultDoesNotUpsertVersionedModels(t *testing.T) {
+	database := testDatabase(t)
+	user := &testVersionedUser{ID: primitive.NewObjectID(), Name: "ann", Version: 1}
+
+	created, err := SaveModelResultWithOptions(user, database, "users", SaveOptions{Upsert: true})
+
+	if !errors.Is(err, ErrStaleVersion) || created {
+		t.Errorf("got created %v and %v, want ErrStaleVersion", created, err)
+	}
+}
+
+// Model keyed by a string, e.g. a UUID.
+type testKeyedUser struct {
+	ID   string `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func (instance *testKeyedUser) GetID() string {
+	return instance.ID
+}
+
+func (instance *testKeyedUser) SetID(id string) {
+	instance.ID = id
+}
+
+func (instance *testKeyedUser) IsZeroID() bool {
+	return instance.ID == ""
+}
+
+// String keyed model protected against lost updates.
+type testKeyedVersionedUser struct {
+	ID      string `bson:"_id"`
+	Name    string `bson:"name"`
+	Version int64  `bson:"version"`
+}
+
+func (instance *testKeyedVersionedUser) GetID() string {
+	return instance.ID
+}
+
+func (instance *testKeyedVersionedUser) SetID(id string) {
+	instance.ID = id
+}
+
+func (instance *testKeyedVersionedUser) IsZeroID() bool {
+	return instance.ID == ""
+}
+
+func (instance *testKeyedVersionedUser) GetVersion() int64 {
+	return instance.Version
+}
+
+func (instance *testKeyedVersionedUser) SetVersion(version int64) {
+	instance.Version = version
+}
+
+// String keyed model keeping track of its creation and update times.
+type testKeyedTimestampedUser struct {
+	ID        string    `bson:"_id"`
+	Name      string    `bson:"name"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+func (instance *testKeyedTimestampedUser) GetID() string {
+	return instance.ID
+}
+
+func (instance *testKeyedTimestampedUser) SetID(id string) {
+	instance.ID = id
+}
+
+func (instance *testKeyedTimestampedUser) IsZeroID() bool {
+	return instance.ID == ""
+}
+
+func (instance *testKeyedTimestampedUser) SetCreatedAt(createdAt time.Time) {
+	instance.CreatedAt = createdAt
+}
+
+func (instance *testKeyedTimestampedUser) SetUpdatedAt(updatedAt time.Time) {
+	instance.UpdatedAt = updatedAt
+}
+
+// String keyed model generating its key when it is first saved.
+type testGeneratedKeyUser struct {
+	ID   string `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+func (instance *testGeneratedKeyUser) GetID() string {
+	return instance.ID
+}
+
+func (instance *testGeneratedKeyUser) SetID(id string) {
+	instance.ID = id
+}
+
+func (instance *testGeneratedKeyUser) IsZeroID() bool {
+	return instance.ID == ""
+}
+
+func (instance *testGeneratedKeyUser) BeforeSave() error {
+	if instance.ID == "" {
+		instance.ID = "generated-" + instance.Name
+	}
+
+	return nil
+}
+
+func TestSaveModelGWithStringKeys(t *testing.T) {
+	database := testDatabase(t)
+	user := &testKeyedUser{ID: "user-1", Name: "ann"}
+
+	if err := SaveModelG[string](user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	user.Name = "anne"
+
+	if err := SaveModelG[string](user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := GetDocumentsTyped[testKeyedUser](database, "users", CreateQuery(bson.M{}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 1 || users[0].ID != "user-1" || users[0].Name != "anne" {
+		t.Errorf("got %+v, want the one re-saved user", users)
+	}
+
+	timestamped := &testKeyedTimestampedUser{ID: "user-2", Name: "bob"}
+
+	if err := SaveModelG[string](timestamped, database, "timestamped_users"); err != nil {
+		t.Fatal(err)
+	}
+
+	createdAt := timestamped.CreatedAt
+
+	if createdAt.IsZero() || !timestamped.UpdatedAt.Equal(createdAt) {
+		t.Fatalf("got created %v and updated %v, want both set on the first save", createdAt, timestamped.UpdatedAt)
+	}
+
+	timestamped.Name = "bobby"
+
+	if err := SaveModelG[string](timestamped, database, "timestamped_users"); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := storedDocument(t, database, "timestamped_users", "user-2")
+	storedCreatedAt, _ := stored["created_at"].(primitive.DateTime)
+
+	if stored["name"] != "bobby" || !storedCreatedAt.Time().Equal(createdAt.Truncate(time.Millisecond)) {
+		t.Errorf("got %v, want the re-saved user with the creation time of the first save", stored)
+	}
+
+	if !timestamped.UpdatedAt.After(createdAt) {
+		t.Errorf("got updated %v, want it after the creation time %v", timestamped.UpdatedAt, createdAt)
+	}
+}
+
+func TestSaveModelGRequiresStringKeys(t *testing.T) {
+	database := testDatabase(t)
+	user := &testKeyedUser{Name: "ann"}
+
+	if err := SaveModelG[string](user, database, "users"); !errors.Is(err, ErrUnsetKey) {
+		t.Errorf("got %v, want ErrUnsetKey", err)
+	}
+
+	count, err := CountDocuments(database, "users", CreateQuery(bson.M{}))
+
+	if err != nil || count != 0 {
+		t.Errorf("got %d documents and %v, want none stored", count, err)
+	}
+}
+
+func TestSaveModelGAcceptsKeysSetByBeforeSave(t *testing.T) {
+	database := testDatabase(t)
+	user := &testGeneratedKeyUser{Name: "ann"}
+
+	if err := SaveModelG[string](user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored := storedDocument(t, database, "users", "generated-ann"); stored["name"] != "ann" {
+		t.Errorf("got %v, want the user stored under its generated key", stored)
+	}
+}
+
+func TestSaveModelGWithVersionedStringKeys(t *testing.T) {
+	database := testDatabase(t)
+	user := &testKeyedVersionedUser{ID: "user-1", Name: "ann"}
+
+	if err := SaveModelG[string](user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Version != 1 {
+		t.Fatalf("got version %d after the insert, want 1", user.Version)
+	}
+
+	stale := *user
+	user.Name = "anne"
+
+	if err := SaveModelG[string](user, database, "users"); err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Name = "annie"
+	err := SaveModelG[string](&stale, database, "users")
+
+	if !errors.Is(err, ErrStaleVersion) || stale.Version != 1 {
+		t.Errorf("got %v with version %d, want ErrStaleVersion and the version restored", err, stale.Version)
+	}
+
+	stored := storedDocument(t, database, "users", "user-1")
+
+	if stored["name"] != "anne" || stored["version"] != int64(2) {
+		t.Errorf("got %v, want the second save stored", stored)
+	}
+}
+
+func TestEnsureIndexIsIdempotent(t *testing.T) {
+	database := testDatabase(t)
+	keys := bson.D{{Key: "name", Value: 1}, {Key: "age", Value: -1}}
+
+	exists, err := IndexExists(database, "users", "name_1_age_-1")
+
+	if err != nil || exists {
+		t.Fatalf("got %v and %v for a missing collection, want false", exists, err)
+	}
+
+	for i_, want := range []bool{true, false} {
+		created, err := EnsureIndex(database, "users", keys, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if created != want {
+			t.Errorf("call %d: got created %v, want %v", i_+1, created, want)
+		}
+	}
+
+	exists, err = IndexExists(database, "users", "name_1_age_-1")
+
+	if err != nil || !exists {
+		t.Errorf("got %v and %v, want the ensured index to exist", exists, err)
+	}
+
+	if indexes := indexNames(t, database, "users"); len(indexes) != 2 {
+		t.Errorf("got %v, want the _id index and the ensured one", indexes)
+	}
+}
+
+func TestEnsureIndexWithANamedIndex(t *testing.T) {
+	database := testDatabase(t)
+	keys := bson.D{{Key: "email", Value: 1}}
+
+	for i_, want := range []bool{true, false} {
+		created, err := EnsureIndex(database, "users", keys, options.Index().SetName("by_email").SetUnique(true))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if created != want {
+			t.Errorf("call %d: got created %v, want %v", i_+1, created, want)
+		}
+	}
+
+	exists, err := IndexExists(database, "users", "email_1")
+
+	if err != nil || exists {
+		t.Errorf("got %v and %v for the default name, want the index named by_email only", exists, err)
+	}
+}
+
+// Skips the test when the server cannot build wildcard indexes,
+// some compatible servers fail on the $** key with an internal error.
+func skipIfWildcardUnsupported(t *testing.T, err error) {
+	t.Helper()
+	skipIfIndexUnsupported(t, err)
+
+	var serverError mongo.ServerError
+
+	if errors.As(err, &serverError) && strings.Contains(err.Error(), "$**") {
+		t.Skipf("wildcard indexes are not supported by the server: %v", err)
+	}
+}
+
+func TestCreateWildcardIndexIsUsed(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"products",
+		bson.M{"attributes": bson.M{"color": "red", "size": 4}},
+		bson.M{"attributes": bson.M{"material": "wood"}},
+	)
+
+	name, err := CreateWildcardIndex(database, "products", "attributes")
+	skipIfWildcardUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "attributes.$**_1" {
+		t.Errorf("got index %s, want attributes.$**_1", name)
+	}
+
+	var explained bson.Raw
+	err = database.RunCommand(context.Background(), bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: "products"},
+			{Key: "filter", Value: bson.M{"attributes.material": "wood"}},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}).Decode(&explained)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := explained.LookupErr("queryPlanner", "winningPlan")
+
+	if err != nil || !strings.Contains(plan.String(), name) {
+		t.Errorf("got plan %v, want it to use the wildcard index", plan)
+	}
+}
+
+func TestCreateWildcardIndexOverEveryField(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "products", bson.M{"color": "red"})
+
+	name, err := CreateWildcardIndex(database, "products", "")
+	skipIfWildcardUnsupported(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "$**_1" {
+		t.Errorf("got index %s, want $**_1", name)
+	}
+}
+
+func TestDeleteDocumentsByIDs(t *testing.T) {
+	database := testDatabase(t)
+	ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+	seedDocuments(t, database, "items", bson.M{"_id": ids[0]}, bson.M{"_id": ids[1]}, bson.M{"_id": ids[2]})
+
+	res, err := DeleteDocumentsByIDs(database, "items", []primitive.ObjectID{ids[0], ids[2], primitive.NewObjectID()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 2 {
+		t.Errorf("deleted %d documents, want 2", res.DeletedCount)
+	}
+
+	res, err = DeleteDocumentsByHexIDs(database, "items", []string{ids[1].Hex()})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.DeletedCount != 1 {
+		t.Errorf("deleted %d documents by hex id, want 1", res.DeletedCount)
+	}
+}
+
+func TestDeleteDocumentsByHexIDsRejectsInvalidIDs(t *testing.T) {
+	database := testDatabase(t)
+	id := primitive.NewObjectID()
+	seedDocuments(t, database, "items", bson.M{"_id": id})
+
+	_, err := DeleteDocumentsByHexIDs(database, "items", []string{id.Hex(), "not-an-id", "zz"})
+
+	if !errors.Is(err, primitive.ErrInvalidHex) {
+		t.Fatalf("got %v, want ErrInvalidHex", err)
+	}
+
+	if !strings.Contains(err.Error(), `"not-an-id"`) {
+		t.Errorf("got %v, want the first invalid id reported", err)
+	}
+
+	if count, _ := CountDocuments(database, "items", CreateQuery(bson.M{})); count != 1 {
+		t.Error("documents were deleted despite the invalid id")
+	}
+}
+
+func TestDeleteDocumentsByIDsWithoutIDs(t *testing.T) {
+	res, err := DeleteDocumentsByIDs(unreachableDatabase(t), "items", nil)
+
+	if err != nil || res.DeletedCount != 0 {
+		t.Errorf("got %+v and %v, want an empty result without a round trip", res, err)
+	}
+}
+
+func TestGetDocumentsByIDsPreservesOrder(t *testing.T) {
+	database := testDatabase(t)
+	ids := make([]primitive.ObjectID, 5)
+	documents := make([]interface{}, len(ids))
+
+	for i_ := range ids {
+		ids[i_] = primitive.NewObjectID()
+		documents[i_] = bson.M{"_id": ids[i_], "n": i_}
+	}
+
+	seedDocuments(t, database, "items", documents...)
+
+	type item struct {
+		ID primitive.ObjectID `bson:"_id"`
+		N  int                `bson:"n"`
+	}
+
+	shuffled := []primitive.ObjectID{ids[3], ids[0], primitive.NewObjectID(), ids[4], ids[1]}
+
+	items, err := GetDocumentsByIDs[item](database, "items", shuffled)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int{3, 0, 4, 1}
+
+	if len(items) != len(want) {
+		t.Fatalf("got %v, want documents %v", items, want)
+	}
+
+	for i_, item := range items {
+		if item.N != want[i_] || item.ID != ids[want[i_]] {
+			t.Fatalf("got %v, want documents %v", items, want)
+		}
+	}
+}
+
+func TestGetDocumentsByIDsWithoutIDs(t *testing.T) {
+	items, err := GetDocumentsByIDs[bson.M](unreachableDatabase(t), "items", nil)
+
+	if err != nil || items == nil || len(items) != 0 {
+		t.Errorf("got %v and %v, want an empty slice without a round trip", items, err)
+	}
+}
+
+func TestWriteConcernIsConfigured(t *testing.T) {
+	query := CreateQuery().WriteConcern(writeconcern.Majority())
+
+	if query.CollectionOptions == nil || query.CollectionOptions.WriteConcern == nil || query.CollectionOptions.WriteConcern.W != "majority" {
+		t.Errorf("got collection options %+v, want a majority write concern", query.CollectionOptions)
+	}
+
+	database := unreachableDatabase(t)
+	configured := OpOptions{WriteConcern: writeconcern.Majority()}.configure(database)
+
+	if configured.Name() != database.Name() || configured.WriteConcern() == nil || configured.WriteConcern().W != "majority" {
+		t.Errorf("got database %s with write concern %+v, want a majority write concern", configured.Name(), configured.WriteConcern())
+	}
+
+	if (OpOptions{}).configure(database) != database {
+		t.Error("got a new database, want the database as is without a write concern")
+	}
+}
+
+// Returns the w value of the write concern the last command with the name was sent with.
+func sentWriteConcern(t *testing.T, commands func(name string) []bson.Raw, name string) interface{} {
+	t.Helper()
+
+	sent := commands(name)
+
+	if len(sent) == 0 {
+		t.Fatalf("no %s command was sent", name)
+	}
+
+	w, err := sent[len(sent)-1].LookupErr("writeConcern", "w")
+
+	if err != nil {
+		return nil
+	}
+
+	if value, ok := w.StringValueOK(); ok {
+		return value
+	}
+
+	return w.AsInt64()
+}
+
+func TestWriteConcernIsSentToTheServer(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	majority := OpOptions{WriteConcern: writeconcern.Majority()}
+
+	_, err := InsertDocumentOpts(database, "items", bson.M{"n": 1}, majority)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := sentWriteConcern(t, commands, "insert"); w != "majority" {
+		t.Errorf("insert: got w %v, want majority", w)
+	}
+
+	_, err = UpdateDocuments(database, "items", CreateQuery(bson.M{"n": 1}).WriteConcern(writeconcern.Majority()), bson.M{"$set": bson.M{"n": 2}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := sentWriteConcern(t, commands, "update"); w != "majority" {
+		t.Errorf("update: got w %v, want majority", w)
+	}
+
+	_, err = DeleteDocumentsOpts(database, "items", CreateQuery(bson.M{"n": 2}), majority)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := sentWriteConcern(t, commands, "delete"); w != "majority" {
+		t.Errorf("delete: got w %v, want majority", w)
+	}
+
+	ctx, cancel := NewContext()
+
+	defer cancel()
+
+	_, err = GetCollectionWithWriteConcern(database, "items", writeconcern.W1()).InsertOne(ctx, bson.M{"n": 3})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := sentWriteConcern(t, commands, "insert"); w != int64(1) {
+		t.Errorf("raw collection insert: got w %v, want 1", w)
+	}
+}
+
+func TestReadConcernIsConfigured(t *testing.T) {
+	query := CreateQuery().ReadFromSecondary().ReadConcern(readconcern.Majority())
+
+	if query.CollectionOptions == nil || query.CollectionOptions.ReadConcern == nil || query.CollectionOptions.ReadConcern.Level != "majority" {
+		t.Fatalf("got collection options %+v, want a majority read concern", query.CollectionOptions)
+	}
+
+	if query.CollectionOptions.ReadPreference == nil {
+		t.Error("the read preference was dropped")
+	}
+}
+
+func TestReadConcernIsSentToTheServer(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedDocuments(t, database, "items", bson.M{"n": 1})
+
+	items, err := GetDocumentsTyped[numbered](database, "items", CreateQuery().ReadConcern(readconcern.Majority()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 {
+		t.Errorf("got %v, want the seeded document", items)
+	}
+
+	sent := commands("find")
+
+	if len(sent) == 0 {
+		t.Fatal("no find command was sent")
+	}
+
+	level, err := sent[len(sent)-1].LookupErr("readConcern", "level")
+
+	if err != nil || level.StringValue() != "majority" {
+		t.Errorf("got read concern %v, want majority", level)
+	}
+}
+
+func TestRunCommandPing(t *testing.T) {
+	database := testDatabase(t)
+
+	res, err := RunCommand(database, bson.D{{Key: "ping", Value: 1}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, isNumber := res["ok"].(float64); !isNumber || ok != 1 {
+		if ok, isNumber := res["ok"].(int32); !isNumber || ok != 1 {
+			t.Errorf("got %v, want ok: 1", res)
+		}
+	}
+}
+
+func TestRunCommandFailures(t *testing.T) {
+	database := testDatabase(t)
+
+	res, err := RunCommand(database, bson.D{{Key: "mongodbutilitiesNoSuchCommand", Value: 1}})
+
+	var commandError mongo.CommandError
+
+	if !errors.As(err, &commandError) || res != nil {
+		t.Errorf("got %v and %v, want the command error", res, err)
+	}
+
+	if !strings.HasPrefix(err.Error(), fmt.Sprintf("mongodbutilities: RunCommand on %q", database.Name())) {
+		t.Errorf("got %v, want the error wrapped with the command and database name", err)
+	}
+}
+
+func TestRunCommandErrorsKeepTheirCause(t *testing.T) {
+	database := unreachableDatabase(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+
+	defer cancel()
+
+	_, err := RunCommandCtx(ctx, database, bson.D{{Key: "ping", Value: 1}})
+
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), `RunCommand on "mongodbutilities_test"`) {
+		t.Errorf("got %v, want the deadline error wrapped with the command and database name", err)
+	}
+}
+
+func TestAddFieldsStage(t *testing.T) {
+	fullName := bson.M{"fullName": bson.M{"$concat": bson.A{"$first", " ", "$last"}}}
+	pipeline := CreateAggregate().AddFields(fullName).Set(bson.M{"n": 1}).Build(nil)
+
+	if got := stageNames(pipeline); len(got) != 2 || got[0] != "$addFields" || got[1] != "$addFields" {
+		t.Fatalf("got %v, want two $addFields stages", got)
+	}
+
+	assertFilter(t, pipeline[0][0].Value, fullName)
+	assertFilter(t, pipeline[1][0].Value, bson.M{"n": 1})
+}
+
+func TestAddFieldsComputesFields(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(t, database, "users", bson.M{"first": "Ann", "last": "Lee", "n": 1}, bson.M{"first": "Bob", "last": "Ray", "n": 2})
+
+	type user struct {
+		FullName string `bson:"fullName"`
+		Double   int    `bson:"double"`
+	}
+
+	users, err := AggregateTyped[user](
+		database,
+		"users",
+		CreateAggregate().
+			AddFields(bson.M{"fullName": bson.M{"$concat": bson.A{"$first", " ", "$last"}}}).
+			Set(bson.M{"double": bson.M{"$multiply": bson.A{"$n", 2}}}).
+			Sort(bson.M{"n": 1}).
+			Build(database),
+	)
+	skipIfNotImplemented(t, err)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 || users[0].FullName != "Ann Lee" || users[1].FullName != "Bob Ray" || users[1].Double != 4 {
+		t.Errorf("got %+v, want the computed fields", users)
+	}
+}
+
+func TestPaginateApproximateSkipsTheExactCount(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedNumbered(t, database, "items", 7)
+
+	result, err := PaginateWithOptions[numbered](database, "items", CreateQuery().Sort(bson.M{"n": 1}), 1, 3, PaginateOptions{Approximate: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Approximate || result.Total != 7 || result.TotalPages != 3 || len(result.Items) != 3 {
+		t.Errorf("got %+v, want an approximate total of 7", result)
+	}
+
+	if counts, aggregates := len(commands("count")), len(commands("aggregate")); counts != 1 || aggregates != 0 {
+		t.Errorf("got %d count and %d aggregate commands, want the estimate only", counts, aggregates)
+	}
+}
+
+func TestPaginateApproximateCountsFilteredQueries(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedNumbered(t, database, "items", 7)
+
+	result, err := PaginateWithOptions[numbered](database, "items", CreateQuery(bson.M{"n": bson.M{"$gt": 2}}), 1, 3, PaginateOptions{Approximate: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Approximate || result.Total != 5 {
+		t.Errorf("got %+v, want an exact total of 5", result)
+	}
+
+	if counts, aggregates := len(commands("count")), len(commands("aggregate")); counts != 0 || aggregates != 1 {
+		t.Errorf("got %d count and %d aggregate commands, want the exact count only", counts, aggregates)
+	}
+
+	result, err = Paginate[numbered](database, "items", CreateQuery(), 1, 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Approximate || result.Total != 7 {
+		t.Errorf("got %+v, want Paginate to count exactly", result)
+	}
+}
+
+func TestSortByKeepsTheFieldOrder(t *testing.T) {
+	query := CreateQuery().SortBy(SortField{Field: "last"}, SortField{Field: "age", Desc: true}, SortField{Field: "first"})
+	want := bson.D{{Key: "last", Value: 1}, {Key: "age", Value: -1}, {Key: "first", Value: 1}}
+	sort, ok := query.FindOptions.Sort.(bson.D)
+
+	if !ok || len(sort) != len(want) {
+		t.Fatalf("got sort %v, want %v", query.FindOptions.Sort, want)
+	}
+
+	for i_ := range want {
+		if sort[i_] != want[i_] {
+			t.Fatalf("got sort %v, want %v", sort, want)
+		}
+	}
+}
+
+func TestSortByTwoKeys(t *testing.T) {
+	database := testDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"users",
+		bson.M{"last": "b", "age": 30, "n": 1},
+		bson.M{"last": "a", "age": 20, "n": 2},
+		bson.M{"last": "b", "age": 40, "n": 3},
+		bson.M{"last": "a", "age": 50, "n": 4},
+	)
+
+	for i_ := 0; i_ < 5; i_++ {
+		users, err := GetDocumentsTyped[numbered](database, "users", CreateQuery().SortBy(SortField{Field: "last"}, SortField{Field: "age", Desc: true}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []int{4, 2, 3, 1}
+
+		if len(users) != len(want) {
+			t.Fatalf("got %v, want %v", users, want)
+		}
+
+		for i_, user := range users {
+			if user.N != want[i_] {
+				t.Fatalf("got %v, want %v", users, want)
+			}
+		}
+	}
+}
+
+func TestStreamAggregateDeliversEveryGroupOnce(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedDocuments(
+		t,
+		database,
+		"orders",
+		bson.M{"status": "paid", "total": 5},
+		bson.M{"status": "paid", "total": 7},
+		bson.M{"status": "open", "total": 1},
+		bson.M{"status": "void", "total": 2},
+	)
+
+	type group struct {
+		ID    string `bson:"_id"`
+		Total int    `bson:"total"`
+	}
+
+	pipeline := CreateAggregate().Group(bson.M{"_id": "$status", "total": bson.M{"$sum": "$total"}}).Build(database)
+	seen := map[string]int{}
+
+	err := StreamAggregate(database, "orders", pipeline, func(item group) error {
+		if _, ok := seen[item.ID]; ok {
+			t.Errorf("group %s was delivered twice", item.ID)
+		}
+
+		seen[item.ID] = item.Total
+
+		return nil
+	}, options.Aggregate().SetAllowDiskUse(true).SetBatchSize(1))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 3 || seen["paid"] != 12 || seen["open"] != 1 || seen["void"] != 2 {
+		t.Errorf("got %v, want the 3 groups", seen)
+	}
+
+	sent := commands("aggregate")
+
+	if len(sent) == 0 {
+		t.Fatal("no aggregate command was sent")
+	}
+
+	if allowDiskUse, err := sent[len(sent)-1].LookupErr("allowDiskUse"); err != nil || !allowDiskUse.Boolean() {
+		t.Errorf("got allowDiskUse %v, want it sent", allowDiskUse)
+	}
+}
+
+func TestStreamAggregateStopsAtTheFirstError(t *testing.T) {
+	database := testDatabase(t)
+	seedNumbered(t, database, "items", 5)
+	stop := errors.New("stop")
+	calls := 0
+
+	pipeline := CreateAggregate().Sort(bson.M{"n": 1}).Build(database)
+
+	err := StreamAggregate(database, "items", pipeline, func(item numbered) error {
+		calls++
+
+		if item.N == 2 {
+			return stop
+		}
+
+		return nil
+	}, options.Aggregate().SetBatchSize(1))
+
+	if !errors.Is(err, stop) || calls != 2 {
+		t.Errorf("got %v after %d calls, want the error of the second call", err, calls)
+	}
+}
+
+func TestAllowDiskUseIsSetOnTheOptions(t *testing.T) {
+	query := CreateQuery().AllowDiskUse(true)
+
+	if query.FindOptions.AllowDiskUse == nil || !*query.FindOptions.AllowDiskUse {
+		t.Errorf("got find options %+v, want allowDiskUse", query.FindOptions)
+	}
+
+	aggregate := CreateAggregate().AllowDiskUse(true)
+
+	if aggregate.AggregateOptions == nil || aggregate.AggregateOptions.AllowDiskUse == nil || !*aggregate.AggregateOptions.AllowDiskUse {
+		t.Errorf("got aggregate options %+v, want allowDiskUse", aggregate.AggregateOptions)
+	}
+
+	aggregate.AllowDiskUse(false)
+
+	if !(aggregate.AggregateOptions.AllowDiskUse != nil && !*aggregate.AggregateOptions.AllowDiskUse) {
+		t.Error("got allowDiskUse, want it disabled")
+	}
+}
+
+func TestAllowDiskUseIsSentToTheServer(t *testing.T) {
+	database, commands := monitoredDatabase(t)
+	seedNumbered(t, database, "items", 3)
+
+	_, err := GetDocumentsTyped[numbered](database, "items", CreateQuery().Sort(bson.M{"n": -1}).AllowDiskUse(true))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggregate := CreateAggregate().Sort(bson.M{"n": -1}).AllowDiskUse(true)
+
+	_, err = AggregateTyped[numbered](database, "items", aggregate.Build(database), aggregate.AggregateOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"find", "aggregate"} {
+		sent := commands(name)
+
+		if len(sent) == 0 {
+			t.Fatalf("no %s command was sent", name)
+		}
+
+		if allowDiskUse, err := sent[len(sent)-1].LookupErr("allowDiskUse"); err != nil || !allowDiskUse.Boolean() {
+			t.Errorf("%s: got allowDiskUse %v, want it sent", name, allowDiskUse)
+		}
+	}
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	database := testDatabase(t)
+	query := CreateQuery(bson.M{"email": "a@example.com"})
+
+	inserted, err := InsertIfAbsent(database, "users", query, bson.M{"email": "a@example.com", "name": "ann"})
+
+	if err != nil || !inserted {
+		t.Fatalf("got %v and %v, want the document inserted", inserted, err)
+	}
+
+	inserted, err = InsertIfAbsent(database, "users", query, bson.M{"email": "a@example.com", "name": "bob"})
+
+	if err != nil || inserted {
+		t.Fatalf("got %v and %v, want the existing document kept", inserted, err)
+	}
+
+	users, err := GetDocumentsTyped[bson.M](database, "users", CreateQuery(bson.M{}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 1 || users[0]["name"] != "ann" {
+		t.Errorf("got %v, want the first document only", users)
+	}
+}
+
+func TestInsertIfAbsentReturnsOtherDuplicateKeys(t *testing.T) {
+	database := testDatabase(t)
+
+	if err := CreateUniqueIndexes(database, "users", IndexField{Field: "email", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	seedDocuments(t, database, "users", bson.M{"email": "a@example.com", "name": "ann"})
+
+	inserted, err := InsertIfAbsent(database, "users", CreateQuery(bson.M{"name": "bob"}), bson.M{"email": "a@example.com", "name": "bob"})
+
+	if !IsDuplicateKeyError(err) || inserted {
+		t.Errorf("got inserted %v and %v, want the duplicate key error on email", inserted, err)
+	}
+}
+
+func TestInsertIfAbsentConcurrently(t *testing.T) {
+	database := testDatabase(t)
+
+	if err := CreateUniqueIndexes(database, "users", IndexField{Field: "email", Ascending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]bool, 8)
+	group := sync.WaitGroup{}
+
+	for i_ := range results {
+		group.Add(1)
+
+		go func(i_ int) {
+			defer group.Done()
+
+			inserted, err := InsertIfAbsent(database, "users", CreateQuery(bson.M{"email": "a@example.com"}), bson.M{"email": "a@example.com", "n": i_})
+
+			if err != nil {
+				t.Error(err)
+			}
+
+			results[i_] = inserted
+		}(i_)
+	}
+
+	group.Wait()
+	inserted := 0
+
+	for _, result := range results {
+		if result {
+			inserted++
+		}
+	}
+
+	if inserted != 1 {
+		t.Errorf("%d calls reported an insert, want exactly 1", inserted)
+	}
+
+	if count, _ := CountDocuments(database, "users", CreateQuery(bson.M{})); count != 1 {
+		t.Errorf("got %d documents, want 1", count)
+	}
+}